@@ -0,0 +1,202 @@
+package scrpc
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/victor-leee/scrpc/github.com/victor-leee/scrpc"
+	"google.golang.org/protobuf/proto"
+	"strings"
+)
+
+// BatchCall is one invocation of a batch request
+type BatchCall struct {
+	// Method is the method of the receiver service to invoke
+	Method string
+	Req    proto.Message
+	// Resp is filled with the response if the invocation succeeded
+	Resp proto.Message
+	// Err is the error of the invocation, it wraps ErrRemote if the handler failed
+	Err error
+}
+
+// BatchRequest sends calls to the receiver service reqCtx.ReqService in a single BATCH message,
+// reqCtx.Req, reqCtx.Resp and reqCtx.ReqMethod are ignored and client interceptors are not applied,
+// the stream interceptors are. The returned error is the failure of the whole batch, the result of each call
+// is set to its Err
+func (c *clientImpl) BatchRequest(ctx *RequestContext, calls []*BatchCall, opts ...CallOpt) error {
+	header, err := c.newHeader(ctx)
+	if err != nil {
+		return err
+	}
+	header.MessageType = scrpc.Header_BATCH
+	done := startStream(ctx.Ctx, c.streamInterceptors, header)
+	err = c.batch(ctx, header, calls, opts)
+	done(err)
+
+	return err
+}
+
+// batch sends calls in a BATCH message with header
+func (c *clientImpl) batch(ctx *RequestContext, header *scrpc.Header, calls []*BatchCall, opts []CallOpt) error {
+	callOpts := c.newCallOptions(opts)
+	enc, err := callOpts.encoding()
+	if err != nil {
+		return err
+	}
+
+	batch := &scrpc.Batch{
+		Items: make([]*scrpc.BatchItem, 0, len(calls)),
+	}
+	for _, call := range calls {
+		body, marshalErr := enc.codec.Marshal(call.Req)
+		if marshalErr != nil {
+			return fmt.Errorf("marshal request of %s failed: %w", call.Method, marshalErr)
+		}
+		batch.Items = append(batch.Items, &scrpc.BatchItem{
+			Header: &scrpc.Header{
+				ReceiverMethodName: call.Method,
+			},
+			Body: body,
+		})
+	}
+	// the bodies of the items are serialized by the codec as well as the envelope
+	rpcReq, err := enc.message(batch, header)
+	if err != nil {
+		return err
+	}
+
+	cname, err := c.route(header.ReceiverServiceName)
+	if err != nil {
+		return err
+	}
+
+	return c.connManager.Func(cname, func(conn *Conn) error {
+		resetDeadline, deadlineErr := c.setRequestDeadline(ctx.Ctx, conn, header.ReceiverServiceName)
+		if deadlineErr != nil {
+			return deadlineErr
+		}
+		defer resetDeadline()
+		connReq, buildErr := enc.messageFor(conn, rpcReq, batch)
+		if buildErr != nil {
+			return buildErr
+		}
+		if _, writeErr := connReq.Write(conn); writeErr != nil {
+			return writeErr
+		}
+		rpcResp, respErr := ReadMessage(conn)
+		if respErr != nil {
+			if rpcResp == nil {
+				conn.MarkBroken()
+			}
+			return respErr
+		}
+		if rpcResp.Header.MessageType == scrpc.Header_THROTTLED {
+			return ErrThrottled
+		}
+		if errMsg, ok := rpcResp.Header.Extra[errorExtraKey]; ok {
+			return fmt.Errorf("%w: %s", ErrRemote, errMsg)
+		}
+		respBatch := &scrpc.Batch{}
+		if unmarshalErr := unmarshalBody(rpcResp.Header, rpcResp.Body, respBatch); unmarshalErr != nil {
+			return unmarshalErr
+		}
+		if len(respBatch.Items) != len(calls) {
+			return fmt.Errorf("batch of %d calls answered with %d results", len(calls), len(respBatch.Items))
+		}
+		if callOpts.header != nil {
+			*callOpts.header = incomingMetadata(rpcResp.Header)
+		}
+		for i, item := range respBatch.Items {
+			calls[i].Err = batchItemResult(rpcResp.Header, item, calls[i].Resp)
+		}
+
+		return nil
+	})
+}
+
+func batchItemResult(batchHeader *scrpc.Header, item *scrpc.BatchItem, resp proto.Message) error {
+	if errMsg, ok := item.GetHeader().GetExtra()[errorExtraKey]; ok {
+		return fmt.Errorf("%w: %s", ErrRemote, errMsg)
+	}
+
+	return unmarshalBody(batchHeader, item.Body, resp)
+}
+
+// serveBatch dispatches the items of a BATCH message to their handlers one by one and builds the response
+func (s *serverImpl) serveBatch(conn *Conn, msg *Message) *Message {
+	enc := responseEncoding(conn, msg.Header, s.compressThreshold)
+	batch := &scrpc.Batch{}
+	if err := unmarshalBody(msg.Header, msg.Body, batch); err != nil {
+		return FromBody([]byte{}, &scrpc.Header{
+			MessageType: scrpc.Header_BATCH,
+			TraceId:     msg.Header.TraceId,
+			SpanId:      msg.Header.SpanId,
+			Extra: map[string]string{
+				errorExtraKey: fmt.Sprintf("unmarshal batch failed: %v", err),
+			},
+		})
+	}
+
+	respBatch := &scrpc.Batch{
+		Items: make([]*scrpc.BatchItem, 0, len(batch.Items)),
+	}
+	for _, item := range batch.Items {
+		respBatch.Items = append(respBatch.Items, s.serveBatchItem(msg.Header, item, enc))
+	}
+
+	header := &scrpc.Header{
+		MessageType: scrpc.Header_BATCH,
+		TraceId:     msg.Header.TraceId,
+		SpanId:      msg.Header.SpanId,
+	}
+	resp, err := enc.message(respBatch, header)
+	if err != nil {
+		logrus.Errorf("[serveBatch] encode response failed: %v", err)
+		return FromProtoMessage(respBatch, header)
+	}
+
+	return resp
+}
+
+func (s *serverImpl) serveBatchItem(batchHeader *scrpc.Header, item *scrpc.BatchItem, enc encoding) *scrpc.BatchItem {
+	// the item is served as if it was sent alone, with the metadata of the batch extended by its own
+	header := proto.Clone(batchHeader).(*scrpc.Header)
+	header.MessageType = scrpc.Header_SIDE_CAR_PROXY
+	header.ReceiverMethodName = item.GetHeader().GetReceiverMethodName()
+	if header.Extra == nil {
+		header.Extra = make(map[string]string)
+	}
+	for k, v := range item.GetHeader().GetExtra() {
+		header.Extra[k] = v
+	}
+
+	failed := func(err error) *scrpc.BatchItem {
+		return &scrpc.BatchItem{
+			Header: &scrpc.Header{
+				Extra: map[string]string{
+					errorExtraKey: err.Error(),
+				},
+			},
+		}
+	}
+	h := s.handler(header)
+	if h == nil || strings.HasPrefix(header.ReceiverMethodName, internalMethodPrefix) {
+		return failed(fmt.Errorf("no handler registered for method %s", header.ReceiverMethodName))
+	}
+	ctx, respHeader := handlerContext(header)
+	resp, err := h(ctx, item.Body)
+	if err != nil {
+		return failed(err)
+	}
+	body, err := enc.codec.Marshal(resp)
+	if err != nil {
+		return failed(err)
+	}
+
+	return &scrpc.BatchItem{
+		Header: &scrpc.Header{
+			Extra: respHeader.extra(),
+		},
+		Body: body,
+	}
+}
@@ -0,0 +1,566 @@
+package scrpc
+
+import (
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/victor-leee/scrpc/codec"
+	"github.com/victor-leee/scrpc/github.com/victor-leee/scrpc"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultStreamWindow is the number of frames a side of a client or bidi stream may send before the peer
+// grants more by STREAM_WINDOW_UPDATE. Each side announces its own window, the client by STREAM_OPEN and
+// the server by the STREAM_OPEN answering it
+const DefaultStreamWindow = 64
+
+// ServerRecvStream is used by a ClientStreamHandler to receive the messages of the client
+type ServerRecvStream interface {
+	// Context returns the context of the request being served
+	Context() context.Context
+	// Recv receives the next message of the client into m, io.EOF is returned once the client half-closed the stream
+	Recv(m proto.Message) error
+}
+
+// ServerBidiStream is used by a BidiStreamHandler to exchange messages with the client
+type ServerBidiStream interface {
+	ServerRecvStream
+	// Send sends m to the client
+	Send(m proto.Message) error
+}
+
+// ClientStreamHandler serves a client-streaming request, the returned message is the single response of the stream
+type ClientStreamHandler func(stream ServerRecvStream) (proto.Message, error)
+
+// BidiStreamHandler serves a bidi-streaming request, the stream ends when the handler returns
+type BidiStreamHandler func(stream ServerBidiStream) error
+
+// ClientStream sends the messages of a client-streaming request
+type ClientStream interface {
+	// Send sends m to the server, io.EOF is returned if the server ended the stream, call CloseAndRecv to get the result
+	Send(m proto.Message) error
+	// CloseAndRecv half-closes the stream and receives the response of the server into resp
+	CloseAndRecv(resp proto.Message) error
+	// Close abandons the stream, it must be called if the stream is abandoned before CloseAndRecv returns
+	Close() error
+}
+
+// BidiStream exchanges messages with the server, Send and Recv may be called from different goroutines
+type BidiStream interface {
+	// Send sends m to the server, io.EOF is returned if the server ended the stream, call Recv to get the result
+	Send(m proto.Message) error
+	// Recv receives the next message of the server into m, io.EOF is returned once the stream ended successfully
+	Recv(m proto.Message) error
+	// CloseSend half-closes the stream, the server is still able to send messages
+	CloseSend() error
+	// Close abandons the stream, it must be called if the stream is abandoned before Recv returns an error
+	Close() error
+}
+
+// streamSession implements both sides of a client or bidi stream over a held connection.
+// A reader goroutine dispatches the inbound messages, frames are queued for Recv and window updates unblock Send.
+// The session is over once the reader saw the STREAM_END of the peer.
+type streamSession struct {
+	conn     *Conn
+	streamID uint64
+	traceID  string
+	spanID   string
+	enc      encoding
+
+	writeMux   sync.Mutex
+	halfClosed bool
+	ended      bool
+
+	mux        sync.Mutex
+	cond       *sync.Cond
+	sendWindow int
+	// awaitOpen is set until the client received the STREAM_OPEN of the server, which sets sendWindow
+	awaitOpen bool
+	sendErr   error
+	broken    bool
+
+	frames     chan *Message
+	recvWindow int
+	consumed   int
+	recvErr    error
+	// peerEnd is the STREAM_END header of the peer, it's set before frames is closed
+	peerEnd    *scrpc.Header
+	readerDone chan struct{}
+}
+
+// newStreamSession starts the session of the stream opened by header, a zero sendWindow is set by the
+// STREAM_OPEN of the server
+func newStreamSession(conn *Conn, header *scrpc.Header, sendWindow, recvWindow int, enc encoding) *streamSession {
+	s := &streamSession{
+		enc:        enc,
+		conn:       conn,
+		streamID:   header.StreamId,
+		traceID:    header.TraceId,
+		spanID:     header.SpanId,
+		sendWindow: sendWindow,
+		awaitOpen:  sendWindow == 0,
+		frames:     make(chan *Message, recvWindow),
+		recvWindow: recvWindow,
+		readerDone: make(chan struct{}),
+	}
+	s.cond = sync.NewCond(&s.mux)
+	go s.readLoop()
+
+	return s
+}
+
+func (s *streamSession) readLoop() {
+	defer close(s.readerDone)
+	framesClosed := false
+	closeFrames := func(err error) {
+		if !framesClosed {
+			s.recvErr = err
+			close(s.frames)
+			framesClosed = true
+		}
+	}
+
+	for {
+		msg, err := ReadMessage(s.conn)
+		if err != nil {
+			closeFrames(err)
+			s.stopSend(err, true)
+			return
+		}
+		header := msg.Header
+		if header.MessageType == scrpc.Header_THROTTLED {
+			closeFrames(ErrThrottled)
+			s.stopSend(ErrThrottled, false)
+			return
+		}
+		if header.StreamId != s.streamID {
+			err = fmt.Errorf("%w: got message of stream %d on stream %d", ErrStreamProtocol, header.StreamId, s.streamID)
+			closeFrames(err)
+			s.stopSend(err, true)
+			return
+		}
+
+		switch header.MessageType {
+		case scrpc.Header_STREAM_FRAME:
+			if framesClosed {
+				continue
+			}
+			select {
+			case s.frames <- msg:
+			default:
+				err = fmt.Errorf("%w: peer exceeded the window of stream %d", ErrStreamProtocol, s.streamID)
+				closeFrames(err)
+				s.stopSend(err, true)
+				return
+			}
+		case scrpc.Header_STREAM_OPEN:
+			if !s.opened(int(header.WindowSize)) {
+				err = fmt.Errorf("%w: unexpected STREAM_OPEN on stream %d", ErrStreamProtocol, s.streamID)
+				closeFrames(err)
+				s.stopSend(err, true)
+				return
+			}
+		case scrpc.Header_STREAM_WINDOW_UPDATE:
+			s.mux.Lock()
+			s.sendWindow += int(header.WindowSize)
+			s.cond.Broadcast()
+			s.mux.Unlock()
+		case scrpc.Header_STREAM_HALF_CLOSE:
+			closeFrames(io.EOF)
+		case scrpc.Header_STREAM_END:
+			s.peerEnd = header
+			closeFrames(endError(header))
+			s.stopSend(io.EOF, false)
+			return
+		default:
+			err = fmt.Errorf("%w: unexpected message type %s", ErrStreamProtocol, header.MessageType)
+			closeFrames(err)
+			s.stopSend(err, true)
+			return
+		}
+	}
+}
+
+// opened sets the send window announced by the STREAM_OPEN of the server, false is returned if none was awaited
+func (s *streamSession) opened(window int) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if !s.awaitOpen {
+		return false
+	}
+	if window <= 0 {
+		window = DefaultStreamWindow
+	}
+	s.awaitOpen = false
+	s.sendWindow += window
+	s.cond.Broadcast()
+
+	return true
+}
+
+// stopSend fails the pending and future sends with err, broken marks the connection unusable
+func (s *streamSession) stopSend(err error, broken bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.sendErr == nil {
+		s.sendErr = err
+	}
+	s.broken = s.broken || broken
+	s.cond.Broadcast()
+}
+
+func (s *streamSession) isBroken() bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return s.broken
+}
+
+func (s *streamSession) send(m proto.Message) error {
+	body, err := s.enc.codec.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	s.mux.Lock()
+	for s.sendWindow == 0 && s.sendErr == nil {
+		s.cond.Wait()
+	}
+	if s.sendErr != nil {
+		s.mux.Unlock()
+		return s.sendErr
+	}
+	s.sendWindow--
+	s.mux.Unlock()
+
+	return s.write(scrpc.Header_STREAM_FRAME, body, 0, nil)
+}
+
+func (s *streamSession) recv(m proto.Message) error {
+	msg, ok := <-s.frames
+	if !ok {
+		return s.recvErr
+	}
+	s.consumed++
+	// grant the consumed frames back once half of the window is consumed
+	if s.consumed*2 >= s.recvWindow {
+		if err := s.write(scrpc.Header_STREAM_WINDOW_UPDATE, nil, s.consumed, nil); err != nil {
+			return err
+		}
+		s.consumed = 0
+	}
+
+	return unmarshalBody(msg.Header, msg.Body, m)
+}
+
+func (s *streamSession) closeSend() error {
+	return s.write(scrpc.Header_STREAM_HALF_CLOSE, nil, 0, nil)
+}
+
+// end sends the STREAM_END of this side, extra carries the result of the stream
+func (s *streamSession) end(extra map[string]string) error {
+	return s.write(scrpc.Header_STREAM_END, nil, 0, extra)
+}
+
+// write writes a stream message, frames are rejected after half-close and nothing is written after STREAM_END
+func (s *streamSession) write(tp scrpc.Header_RPCMessageType, body []byte, window int, extra map[string]string) error {
+	s.writeMux.Lock()
+	defer s.writeMux.Unlock()
+
+	switch {
+	case s.ended:
+		if tp == scrpc.Header_STREAM_WINDOW_UPDATE || tp == scrpc.Header_STREAM_END {
+			return nil
+		}
+		return ErrStreamClosed
+	case s.halfClosed && tp == scrpc.Header_STREAM_HALF_CLOSE:
+		return nil
+	case s.halfClosed && tp == scrpc.Header_STREAM_FRAME:
+		return ErrStreamClosed
+	}
+	if body == nil {
+		body = []byte{}
+	}
+	header := &scrpc.Header{
+		MessageType: tp,
+		TraceId:     s.traceID,
+		SpanId:      s.spanID,
+		StreamId:    s.streamID,
+		WindowSize:  uint32(window),
+		Extra:       extra,
+	}
+	if tp == scrpc.Header_STREAM_FRAME {
+		var err error
+		if body, err = s.enc.apply(body, header); err != nil {
+			return err
+		}
+	}
+	_, err := FromBody(body, header).Write(s.conn)
+	if err != nil {
+		// the peer can't be in sync with us anymore, closing the connection stops the reader as well
+		s.stopSend(err, true)
+		if closeErr := s.conn.Close(); closeErr != nil {
+			logrus.Warnf("[streamSession.write] close connection failed: %v", closeErr)
+		}
+		return err
+	}
+	switch tp {
+	case scrpc.Header_STREAM_HALF_CLOSE:
+		s.halfClosed = true
+	case scrpc.Header_STREAM_END:
+		s.halfClosed = true
+		s.ended = true
+	}
+
+	return nil
+}
+
+// abandon stops the session without the STREAM_END handshake, the connection can't be reused
+func (s *streamSession) abandon() {
+	s.writeMux.Lock()
+	s.ended = true
+	s.writeMux.Unlock()
+
+	s.stopSend(ErrStreamClosed, true)
+	if err := s.conn.Close(); err != nil {
+		logrus.Warnf("[streamSession.abandon] close connection failed: %v", err)
+	}
+	<-s.readerDone
+}
+
+// result returns the result of the stream once the reader is done, nil if the peer ended it successfully
+func (s *streamSession) result() error {
+	if s.peerEnd != nil {
+		if err := endError(s.peerEnd); err != io.EOF {
+			return err
+		}
+		return nil
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return s.sendErr
+}
+
+// endError returns the result carried by a STREAM_END header
+func endError(header *scrpc.Header) error {
+	if errMsg, ok := header.Extra[errorExtraKey]; ok {
+		return fmt.Errorf("%w: %s", ErrRemote, errMsg)
+	}
+
+	return io.EOF
+}
+
+// clientStream is the client side of client and bidi streams
+type clientStream struct {
+	session *streamSession
+}
+
+func (c *clientStream) Send(m proto.Message) error {
+	return c.session.send(m)
+}
+
+func (c *clientStream) Recv(m proto.Message) error {
+	return c.session.recv(m)
+}
+
+func (c *clientStream) CloseSend() error {
+	return c.session.closeSend()
+}
+
+func (c *clientStream) CloseAndRecv(resp proto.Message) error {
+	if err := c.session.closeSend(); err != nil {
+		return err
+	}
+	if err := c.session.recv(resp); err != nil {
+		if err == io.EOF {
+			return fmt.Errorf("%w: stream ended without response", ErrStreamProtocol)
+		}
+		return err
+	}
+	// the response is followed by the STREAM_END of the server
+	if err := c.session.recv(resp); err != io.EOF {
+		if err == nil {
+			return fmt.Errorf("%w: more than one response", ErrStreamProtocol)
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (c *clientStream) Close() error {
+	select {
+	case <-c.session.readerDone:
+	default:
+		c.session.abandon()
+	}
+
+	return nil
+}
+
+// ClientStreamRequest opens a client-streaming request, reqCtx.Req and reqCtx.Resp are ignored
+// and client interceptors are not applied, the stream interceptors are
+func (c *clientImpl) ClientStreamRequest(ctx *RequestContext, opts ...CallOpt) (ClientStream, error) {
+	return c.openStream(ctx, opts)
+}
+
+// BidiStreamRequest opens a bidi-streaming request, reqCtx.Req and reqCtx.Resp are ignored
+// and client interceptors are not applied, the stream interceptors are
+func (c *clientImpl) BidiStreamRequest(ctx *RequestContext, opts ...CallOpt) (BidiStream, error) {
+	return c.openStream(ctx, opts)
+}
+
+func (c *clientImpl) openStream(ctx *RequestContext, opts []CallOpt) (*clientStream, error) {
+	header, err := c.newHeader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	callOpts := c.newCallOptions(opts)
+	recvWindow := callOpts.streamWindow
+	if recvWindow <= 0 {
+		recvWindow = DefaultStreamWindow
+	}
+	header.MessageType = scrpc.Header_STREAM_OPEN
+	header.StreamId = atomic.AddUint64(&c.streamSeq, 1)
+	header.WindowSize = uint32(recvWindow)
+	done := startStream(ctx.Ctx, c.streamInterceptors, header)
+	stream, err := c.startSession(header, callOpts, recvWindow, done)
+	if err != nil {
+		done(err)
+		return nil, err
+	}
+
+	return stream, nil
+}
+
+// startSession sends the STREAM_OPEN header and starts the session of the stream, which reports its result to done
+func (c *clientImpl) startSession(header *scrpc.Header, callOpts *callOptions, recvWindow int,
+	done func(err error)) (*clientStream, error) {
+	enc, err := callOpts.encoding()
+	if err != nil {
+		return nil, err
+	}
+
+	cname, err := c.route(header.ReceiverServiceName)
+	if err != nil {
+		return nil, err
+	}
+	conn, release, err := c.connManager.Hold(cname)
+	if err != nil {
+		return nil, err
+	}
+	if !conn.Supports(FeatureStreams) {
+		release(false)
+		return nil, fmt.Errorf("%w: stream to %s", ErrUnsupportedFeature, header.ReceiverServiceName)
+	}
+	// the codec and the compressor are announced by STREAM_OPEN so that the server encodes its frames alike
+	enc = enc.forConn(conn)
+	header.Compression = enc.comp.name
+	if enc.codec.Name() != codec.Proto {
+		header.Codec = enc.codec.Name()
+	}
+	if _, err = FromBody([]byte{}, header).Write(conn); err != nil {
+		release(true)
+		return nil, err
+	}
+
+	// nothing is sent until the server announced its window
+	session := newStreamSession(conn, header, 0, recvWindow, enc)
+	go func() {
+		<-session.readerDone
+		if session.peerEnd != nil {
+			if callOpts.header != nil {
+				*callOpts.header = incomingMetadata(session.peerEnd)
+			}
+			// acknowledge the STREAM_END of the server so it stops reading the connection
+			if endErr := session.end(nil); endErr != nil {
+				logrus.Warnf("[startSession] acknowledge end of stream %d failed: %v", session.streamID, endErr)
+			}
+		}
+		release(session.isBroken())
+		done(session.result())
+	}()
+
+	return &clientStream{
+		session: session,
+	}, nil
+}
+
+// serverBidiStream is the server side of client and bidi streams
+type serverBidiStream struct {
+	ctx     context.Context
+	session *streamSession
+}
+
+func (s *serverBidiStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *serverBidiStream) Send(m proto.Message) error {
+	return s.session.send(m)
+}
+
+func (s *serverBidiStream) Recv(m proto.Message) error {
+	return s.session.recv(m)
+}
+
+// serveBidiStream serves the client or bidi stream opened by msg until both sides ended it, recvWindow is
+// announced to the client and interceptors are told about the stream. An error is returned if the connection
+// can't be used anymore
+func serveBidiStream(conn *Conn, msg *Message, h BidiStreamHandler, enc encoding, recvWindow int,
+	interceptors []StreamInterceptor) error {
+	sendWindow := int(msg.Header.WindowSize)
+	if sendWindow <= 0 {
+		sendWindow = DefaultStreamWindow
+	}
+	session := newStreamSession(conn, msg.Header, sendWindow, recvWindow, enc)
+	if err := session.write(scrpc.Header_STREAM_OPEN, nil, recvWindow, nil); err != nil {
+		<-session.readerDone
+		return err
+	}
+	ctx, respHeader := handlerContext(msg.Header)
+
+	extra := make(map[string]string)
+	if h == nil {
+		extra[errorExtraKey] = fmt.Sprintf("no handler registered for method %s", msg.Header.ReceiverMethodName)
+	} else {
+		done := startStream(ctx, interceptors, msg.Header)
+		handlerErr := h(&serverBidiStream{ctx: ctx, session: session})
+		done(handlerErr)
+		if handlerErr != nil {
+			extra[errorExtraKey] = handlerErr.Error()
+		}
+	}
+	for k, v := range respHeader.extra() {
+		extra[k] = v
+	}
+	if err := session.end(extra); err != nil {
+		<-session.readerDone
+		return err
+	}
+	// the client acknowledges our STREAM_END, after which the connection is in sync again
+	<-session.readerDone
+	if session.isBroken() {
+		return fmt.Errorf("stream %d broke the connection: %w", session.streamID, session.recvErr)
+	}
+
+	return nil
+}
+
+// clientStreamToBidi adapts a ClientStreamHandler, the response is sent as the only frame of the server
+func clientStreamToBidi(h ClientStreamHandler) BidiStreamHandler {
+	return func(stream ServerBidiStream) error {
+		resp, err := h(stream)
+		if err != nil {
+			return err
+		}
+
+		return stream.Send(resp)
+	}
+}
@@ -0,0 +1,84 @@
+package scrpc
+
+import (
+	"context"
+)
+
+// DefaultMaxInFlight is the default number of asynchronous requests a client runs concurrently
+const DefaultMaxInFlight = 256
+
+// Call is the future of an asynchronous request issued by Client.Go
+type Call struct {
+	// ReqCtx is the request of the call, ReqCtx.Resp is filled once the call succeeded
+	ReqCtx *RequestContext
+	done   chan struct{}
+	err    error
+	// cancel cancels the request, it's called when the caller stops waiting for it
+	cancel context.CancelFunc
+}
+
+// Done returns a channel which is closed once the call finished
+func (c *Call) Done() <-chan struct{} {
+	return c.done
+}
+
+// Wait blocks until the call finished and returns its result, or returns the error of ctx if it's done first.
+// The call is abandoned then: the request is canceled and its in-flight slot is released
+func (c *Call) Wait(ctx context.Context) error {
+	select {
+	case <-c.done:
+		return c.err
+	case <-ctx.Done():
+		c.cancel()
+		return ctx.Err()
+	}
+}
+
+// Err returns the result of the call, it's only meaningful once Done is closed
+func (c *Call) Err() error {
+	select {
+	case <-c.done:
+		return c.err
+	default:
+		return nil
+	}
+}
+
+func (c *Call) finish(err error) {
+	c.err = err
+	close(c.done)
+}
+
+func (c *clientImpl) Go(ctx *RequestContext, opts ...CallOpt) *Call {
+	parent := ctx.Ctx
+	if parent == nil {
+		parent = context.Background()
+	}
+	reqCtx, cancel := context.WithCancel(parent)
+	call := &Call{
+		ReqCtx: ctx,
+		done:   make(chan struct{}),
+		cancel: cancel,
+	}
+	// the request runs with the cancelable context, ctx itself is left untouched
+	req := *ctx
+	req.Ctx = reqCtx
+
+	go func() {
+		defer cancel()
+		// wait for an in-flight slot, giving up if the request is canceled meanwhile
+		select {
+		case c.inFlight <- struct{}{}:
+		case <-reqCtx.Done():
+			call.finish(reqCtx.Err())
+			return
+		}
+		defer func() {
+			<-c.inFlight
+		}()
+
+		call.finish(c.UnaryRPCRequest(&req, opts...))
+	}()
+
+	return call
+}
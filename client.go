@@ -2,9 +2,15 @@ package scrpc
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
 	"github.com/victor-leee/scrpc/github.com/victor-leee/scrpc"
+	"github.com/victor-leee/scrpc/metadata"
 	"google.golang.org/protobuf/proto"
-	"io"
+	"net"
+	"os"
+	"time"
 )
 
 type RequestContext struct {
@@ -18,71 +24,504 @@ type RequestContext struct {
 }
 
 type Client interface {
-	UnaryRPCRequest(reqCtx *RequestContext) error
+	UnaryRPCRequest(reqCtx *RequestContext, opts ...CallOpt) error
+	// Go issues the unary request asynchronously and returns its future immediately,
+	// at most a limited number of requests run concurrently and the others wait for their turn
+	Go(reqCtx *RequestContext, opts ...CallOpt) *Call
+	// BatchRequest sends several calls to the same receiver service in a single message
+	BatchRequest(reqCtx *RequestContext, calls []*BatchCall, opts ...CallOpt) error
+	// OneWayRequest sends a request expecting no response, it returns once the request is written
+	OneWayRequest(reqCtx *RequestContext, opts ...CallOpt) error
+	// ServerStreamRequest calls a server-streaming method and returns the stream of responses
+	ServerStreamRequest(reqCtx *RequestContext, opts ...CallOpt) (ServerStreamClient, error)
+	// ClientStreamRequest opens a client-streaming request
+	ClientStreamRequest(reqCtx *RequestContext, opts ...CallOpt) (ClientStream, error)
+	// BidiStreamRequest opens a bidi-streaming request
+	BidiStreamRequest(reqCtx *RequestContext, opts ...CallOpt) (BidiStream, error)
+	// PoolStats returns the stats of the connection pools used by the client keyed by cname
+	PoolStats() map[string]PoolStats
+	// Close stops watching the configuration file and closes the connection pools, the subsequent requests fail
+	// with ErrClosed
+	Close() error
 }
 
 type clientImpl struct {
-	connManager Manager
+	connManager        Manager
+	interceptors       []ClientInterceptor
+	streamInterceptors []StreamInterceptor
+	// streamSeq generates the ids of client and bidi streams
+	streamSeq uint64
+	// inFlight is the semaphore limiting the asynchronous requests running concurrently
+	inFlight chan struct{}
+	// compression is the default compression of request bodies
+	compression compression
+	// codec is the name of the default codec of request bodies
+	codec string
+	// readOpts are set by WithMaxResponseSize, the limits of the configuration are used if they are nil
+	readOpts []ReadOpt
+	// cfg is the resolved configuration, its error is returned by every request if it's invalid
+	cfg liveConfig
 }
 
-func NewClient() Client {
-	return &clientImpl{
-		connManager: InitConnManager(func(cname string) (ConnPool, error) {
-			localTransportCfg := GetConfig().LocalTransportConfig
-			return NewPool(WithInitSize(localTransportCfg.PoolCfg.InitSize), WithMaxSize(localTransportCfg.PoolCfg.MaxSize), WithFactory(func() (*Conn, error) {
-				return Dial(localTransportCfg.Protocol, cname, WithType(ConnTypeSideCar2Local))
-			}))
-		}),
+type ClientOpt func(client *clientImpl)
+
+// WithConfig sets the configuration of the client, its zero-valued fields are filled by DefaultConfig.
+// The options setting the same values explicitly take precedence. If the resolved configuration is invalid,
+// NewClient returns an error wrapping ErrInvalidConfig and every request fails with it
+func WithConfig(cfg *Config) ClientOpt {
+	return func(client *clientImpl) {
+		client.cfg.explicit = cfg
+	}
+}
+
+// WithConfigFile reads the configuration of the client from the file at path, see FileConfig, it takes precedence
+// over WithConfig. The file is watched and its changes are applied to the subsequent requests, the connection
+// pools are resized and the new connections are dialed with the new settings. A change which can't be parsed,
+// doesn't pass Validate or changes the transport mode or paths is logged and ignored. An invalid initial file
+// fails the requests until it's fixed. Close stops watching the file
+func WithConfigFile(path string) ClientOpt {
+	return func(client *clientImpl) {
+		client.cfg.file = path
+	}
+}
+
+// WithClientInterceptors appends interceptors to the client, they are called in the order they are added
+func WithClientInterceptors(interceptors ...ClientInterceptor) ClientOpt {
+	return func(client *clientImpl) {
+		client.interceptors = append(client.interceptors, interceptors...)
+	}
+}
+
+// WithClientStreamInterceptors appends interceptors of the streams and batches started by the client,
+// they are called in the order they are added
+func WithClientStreamInterceptors(interceptors ...StreamInterceptor) ClientOpt {
+	return func(client *clientImpl) {
+		client.streamInterceptors = append(client.streamInterceptors, interceptors...)
 	}
 }
 
-func (c *clientImpl) UnaryRPCRequest(ctx *RequestContext) error {
+// WithCompressor compresses request bodies with the compressor registered as name in package compress,
+// servers compress their responses with it as well
+func WithCompressor(name string) ClientOpt {
+	return func(client *clientImpl) {
+		client.compression.name = name
+	}
+}
+
+// WithCompressThreshold sets the body size in bytes from which bodies are compressed, DefaultCompressThreshold by default
+func WithCompressThreshold(n int) ClientOpt {
+	return func(client *clientImpl) {
+		client.compression.threshold = n
+	}
+}
+
+// WithCodec serializes request bodies with the codec registered as name in package codec,
+// servers answer with it as well
+func WithCodec(name string) ClientOpt {
+	return func(client *clientImpl) {
+		client.codec = name
+	}
+}
+
+// WithMaxResponseSize limits the size of the header and the body of responses, Config.Limits by default. An oversized response fails the request with ErrMessageTooLarge
+func WithMaxResponseSize(maxHeaderSize, maxBodySize uint64) ClientOpt {
+	return func(client *clientImpl) {
+		client.readOpts = []ReadOpt{MaxHeaderSize(maxHeaderSize), MaxBodySize(maxBodySize)}
+	}
+}
+
+// callOptions are the options of a single request
+type callOptions struct {
+	header       *metadata.MD
+	streamWindow int
+	compression  compression
+	codec        string
+}
+
+func (o *callOptions) encoding() (encoding, error) {
+	return newEncoding(o.codec, o.compression)
+}
+
+type CallOpt func(opts *callOptions)
+
+// Header captures the metadata the server attached to the response into md
+func Header(md *metadata.MD) CallOpt {
+	return func(opts *callOptions) {
+		opts.header = md
+	}
+}
+
+// UseCompressor overrides the compressor of the client for the request, an empty name disables compression
+func UseCompressor(name string) CallOpt {
+	return func(opts *callOptions) {
+		opts.compression.name = name
+	}
+}
+
+// UseCodec overrides the codec of the client for the request
+func UseCodec(name string) CallOpt {
+	return func(opts *callOptions) {
+		opts.codec = name
+	}
+}
+
+// WithMaxInFlight sets the number of asynchronous requests running concurrently, Config.Limits.MaxInFlight by default,
+// a non-positive n is ignored
+func WithMaxInFlight(n int) ClientOpt {
+	return func(client *clientImpl) {
+		if n > 0 {
+			client.inFlight = make(chan struct{}, n)
+		}
+	}
+}
+
+// StreamWindow sets the receive window of a client or bidi stream counted in frames,
+// DefaultStreamWindow is used by default
+func StreamWindow(frames int) CallOpt {
+	return func(opts *callOptions) {
+		opts.streamWindow = frames
+	}
+}
+
+// NewClient creates a client configured by opts. If the configuration is invalid, the error wrapping
+// ErrInvalidConfig is returned along with a client failing its requests with it, until the file set by
+// WithConfigFile is fixed
+func NewClient(opts ...ClientOpt) (Client, error) {
+	c := &clientImpl{
+		compression: compression{
+			threshold: DefaultCompressThreshold,
+		},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	// the built-in configuration keeps the client usable if the configuration is invalid
+	cfgErr := c.cfg.resolve()
+	if c.inFlight == nil {
+		c.inFlight = make(chan struct{}, c.cfg.config().Limits.MaxInFlight)
+	}
+	c.connManager = InitConnManager(func(cname string) (ConnPool, error) {
+		if err := c.cfg.err(); err != nil {
+			return nil, err
+		}
+		poolCfg := c.cfg.config().transport().PoolCfg
+		return NewPool(WithInitSize(poolCfg.InitSize), WithMaxSize(poolCfg.MaxSize), WithFactory(func() (*Conn, error) {
+			// the current configuration is read on every dial so that a reload applies to the new connections
+			cfg := c.cfg.config()
+			transportCfg := cfg.transport()
+			dialOpts := append(cfg.dialOpts(transportCfg, c.responseLimits(cfg)), WithType(cfg.connType()))
+			return DialTimeout(transportCfg.Protocol, cname, cfg.Timeouts.GetDial(), dialOpts...)
+		}))
+	})
+	c.cfg.watch(c.reload)
+
+	return c, cfgErr
+}
+
+// reload applies the pool sizes of a reloaded configuration and closes the pools of the peers it removed
+func (c *clientImpl) reload(old, cfg *Config) {
+	resize := func(cname string, maxSize int) {
+		if err := c.connManager.Resize(cname, maxSize); err != nil {
+			logrus.Warnf("[clientImpl.reload] resize pool %s failed: %v", cname, err)
+		}
+	}
+	resize(cfg.LocalTransportConfig.Path, cfg.LocalTransportConfig.PoolCfg.MaxSize)
+	addrs := make(map[string]bool, len(cfg.Peers))
+	for _, addr := range cfg.Peers {
+		addrs[addr] = true
+		resize(addr, cfg.RemoteTransportConfig.PoolCfg.MaxSize)
+	}
+	if old == nil {
+		return
+	}
+	for _, addr := range old.Peers {
+		if addrs[addr] {
+			continue
+		}
+		if err := c.connManager.UpdateServerInfo(addr, InstanceDelete); err != nil {
+			logrus.Warnf("[clientImpl.reload] close pool %s failed: %v", addr, err)
+		}
+	}
+}
+
+func (c *clientImpl) Close() error {
+	c.cfg.close()
+
+	return c.connManager.Close()
+}
+
+// responseLimits are the limits of the responses, the ones of WithMaxResponseSize or else the ones of cfg
+func (c *clientImpl) responseLimits(cfg *Config) []ReadOpt {
+	if c.readOpts != nil {
+		return c.readOpts
+	}
+
+	return []ReadOpt{MaxHeaderSize(cfg.Limits.MaxHeaderSize), MaxBodySize(cfg.Limits.MaxBodySize)}
+}
+
+// route returns the key in the Manager of the connections reaching service, the path of the local side-car
+// or the address of the side-car of service in TransportRemote mode
+func (c *clientImpl) route(service string) (string, error) {
+	cfg := c.cfg.config()
+	if cfg.Mode == TransportRemote {
+		return cfg.peer(service)
+	}
+
+	return cfg.LocalTransportConfig.Path, nil
+}
+
+// setRequestDeadline bounds the request to service on conn by its request timeout and the deadline of ctx,
+// and interrupts it once ctx is canceled. The returned function lifts the bound
+func (c *clientImpl) setRequestDeadline(ctx context.Context, conn *Conn, service string) (func(), error) {
+	deadline, ok := requestDeadline(ctx, c.cfg.config().requestTimeout(service))
+	if !ok && ctx.Done() == nil {
+		return func() {}, nil
+	}
+	if ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return nil, err
+		}
+	}
+	stop := interruptOnDone(ctx, conn)
+
+	return func() {
+		stop()
+		if err := conn.SetDeadline(time.Time{}); err != nil {
+			logrus.Warnf("[setRequestDeadline] reset deadline failed: %v", err)
+		}
+	}, nil
+}
+
+// requestDeadline returns the earliest of the deadline of ctx and timeout from now, ok is false if there's none
+func requestDeadline(ctx context.Context, timeout time.Duration) (deadline time.Time, ok bool) {
+	deadline, ok = ctx.Deadline()
+	if timeout > 0 {
+		if d := time.Now().Add(timeout); !ok || d.Before(deadline) {
+			deadline, ok = d, true
+		}
+	}
+
+	return deadline, ok
+}
+
+// contextError returns the error of ctx if err is the expiry of a deadline set by requestDeadline from ctx or
+// an interruption by interruptOnDone, otherwise err. The deadline of the connection may expire before ctx reports it
+func contextError(ctx context.Context, err error) error {
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		return err
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+
+	return err
+}
+
+// interruptOnDone interrupts the pending read or write on conn once ctx is done,
+// the returned function stops watching ctx and returns once it's safe to set a deadline on conn again
+func interruptOnDone(ctx context.Context, conn *Conn) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			// a past deadline unblocks the pending read or write of the request
+			if err := conn.SetDeadline(time.Unix(1, 0)); err != nil {
+				logrus.Warnf("[interruptOnDone] interrupt canceled request failed: %v", err)
+			}
+		case <-stop:
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-stopped
+	}
+}
+
+func (c *clientImpl) newCallOptions(opts []CallOpt) *callOptions {
+	callOpts := &callOptions{
+		compression: c.compression,
+		codec:       c.codec,
+	}
+	for _, opt := range opts {
+		opt(callOpts)
+	}
+
+	return callOpts
+}
+
+func (c *clientImpl) UnaryRPCRequest(ctx *RequestContext, opts ...CallOpt) error {
+	header, err := c.newHeader(ctx)
+	if err != nil {
+		return err
+	}
+	callOpts := c.newCallOptions(opts)
+	invoker := func(invokeCtx context.Context, header *scrpc.Header, req, resp proto.Message) error {
+		return c.invokeWithRetry(invokeCtx, header, req, resp, callOpts)
+	}
+
+	return chainClientInterceptors(c.interceptors, invoker)(ctx.Ctx, header, ctx.Req, ctx.Resp)
+}
+
+func (c *clientImpl) OneWayRequest(ctx *RequestContext, opts ...CallOpt) error {
+	header, err := c.newHeader(ctx)
+	if err != nil {
+		return err
+	}
+	header.OneWay = true
+	callOpts := c.newCallOptions(opts)
+	invoker := func(invokeCtx context.Context, header *scrpc.Header, req, _ proto.Message) error {
+		return c.invokeOneWay(invokeCtx, header, req, callOpts)
+	}
+
+	return chainClientInterceptors(c.interceptors, invoker)(ctx.Ctx, header, ctx.Req, nil)
+}
+
+func (c *clientImpl) invokeOneWay(_ context.Context, header *scrpc.Header, req proto.Message, opts *callOptions) error {
+	enc, err := opts.encoding()
+	if err != nil {
+		return err
+	}
+	rpcReq, err := enc.message(req, header)
+	if err != nil {
+		return err
+	}
+
+	cname, err := c.route(header.ReceiverServiceName)
+	if err != nil {
+		return err
+	}
+
+	return c.connManager.Func(cname, func(conn *Conn) error {
+		connReq, buildErr := enc.messageFor(conn, rpcReq, req)
+		if buildErr != nil {
+			return buildErr
+		}
+		_, writeErr := connReq.Write(conn)
+		return writeErr
+	})
+}
+
+// newHeader builds the outbound header of the request described by ctx
+func (c *clientImpl) newHeader(ctx *RequestContext) (*scrpc.Header, error) {
 	if ctx.MessageType == nil {
 		ctx.MessageType = scrpc.Header_SIDE_CAR_PROXY.Enum()
 	}
-	rpcReq := FromProtoMessage(ctx.Req, &scrpc.Header{
+	if ctx.Ctx == nil {
+		ctx.Ctx = context.Background()
+	}
+	header := &scrpc.Header{
 		ReceiverServiceName: ctx.ReqService,
 		ReceiverMethodName:  ctx.ReqMethod,
 		SenderServiceName:   ctx.SenderService,
 		MessageType:         *ctx.MessageType,
-		TraceId:             "todo",                  // TODO
-		Extra:               make(map[string]string), // TODO
-	})
-	outErr := c.connManager.Func(GetConfig().LocalTransportConfig.Path, func(conn *Conn) error {
-		if _, writeErr := rpcReq.Write(conn); writeErr != nil {
+		Extra:               make(map[string]string),
+	}
+	if err := fillMetadata(ctx.Ctx, header); err != nil {
+		return nil, err
+	}
+	fillTrace(ctx.Ctx, header)
+
+	return header, nil
+}
+
+func (c *clientImpl) PoolStats() map[string]PoolStats {
+	return c.connManager.PoolStats()
+}
+
+// invokeWithRetry invokes the request and retries it according to the RetryPolicy of its receiver service
+func (c *clientImpl) invokeWithRetry(ctx context.Context, header *scrpc.Header, req, resp proto.Message, opts *callOptions) error {
+	policy := c.cfg.config().servicePolicy(header.ReceiverServiceName)
+	if policy == nil || policy.Retry == nil {
+		return c.invoke(ctx, header, req, resp, opts)
+	}
+	retry := policy.Retry
+	backoff := retry.Backoff
+	for attempt := 1; ; attempt++ {
+		err := c.invoke(ctx, header, req, resp, opts)
+		if err == nil || attempt >= retry.MaxAttempts || !retryable(err) {
+			return err
+		}
+		logrus.Debugf("[invokeWithRetry] attempt %d to %s failed, retry in %v: %v", attempt, header.ReceiverServiceName, backoff, err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		if backoff *= 2; retry.MaxBackoff > 0 && backoff > retry.MaxBackoff {
+			backoff = retry.MaxBackoff
+		}
+	}
+}
+
+// retryable reports whether a request failing with err was not handled, so it can be sent again
+func retryable(err error) bool {
+	var opErr *net.OpError
+
+	return errors.Is(err, ErrThrottled) || errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+func (c *clientImpl) invoke(ctx context.Context, header *scrpc.Header, req, resp proto.Message, opts *callOptions) error {
+	enc, err := opts.encoding()
+	if err != nil {
+		return err
+	}
+	rpcReq, err := enc.message(req, header)
+	if err != nil {
+		return err
+	}
+	cname, err := c.route(header.ReceiverServiceName)
+	if err != nil {
+		return err
+	}
+	outErr := c.connManager.Func(cname, func(conn *Conn) error {
+		resetDeadline, deadlineErr := c.setRequestDeadline(ctx, conn, header.ReceiverServiceName)
+		if deadlineErr != nil {
+			return deadlineErr
+		}
+		defer resetDeadline()
+		connReq, buildErr := enc.messageFor(conn, rpcReq, req)
+		if buildErr != nil {
+			return buildErr
+		}
+		if _, writeErr := connReq.Write(conn); writeErr != nil {
 			return writeErr
 		}
-		resp, respErr := FromReader(conn, blockRead)
+		rpcResp, respErr := ReadMessage(conn)
 		if respErr != nil {
+			if rpcResp == nil {
+				// the response may still arrive, e.g. after a timeout, so the connection is out of sync
+				conn.MarkBroken()
+			}
 			return respErr
 		}
-		if unmarshalErr := proto.Unmarshal(resp.Body, ctx.Resp); unmarshalErr != nil {
+		if errMsg, ok := rpcResp.Header.Extra[errorExtraKey]; ok {
+			return fmt.Errorf("%w: %s", ErrRemote, errMsg)
+		}
+		if unmarshalErr := unmarshalBody(rpcResp.Header, rpcResp.Body, resp); unmarshalErr != nil {
 			return unmarshalErr
 		}
-		if resp.Header != nil && resp.Header.MessageType == scrpc.Header_THROTTLED {
+		if opts.header != nil {
+			*opts.header = incomingMetadata(rpcResp.Header)
+		}
+		if rpcResp.Header != nil && rpcResp.Header.MessageType == scrpc.Header_THROTTLED {
 			return ErrThrottled
 		}
 
 		return nil
 	})
 	if outErr != nil {
-		return outErr
+		return contextError(ctx, outErr)
 	}
 
 	return nil
 }
-
-func blockRead(reader io.Reader, size uint64) ([]byte, error) {
-	b := make([]byte, size)
-	already := 0
-	inc := 0
-	var err error
-	for uint64(already) < size {
-		if inc, err = reader.Read(b[already:]); err != nil {
-			return nil, err
-		}
-		already += inc
-	}
-
-	return b, nil
-}
@@ -0,0 +1,146 @@
+// Command scrpc-sidecar runs the side-car proxy of scrpc: it serves the applications on the unix socket of
+// LocalTransportConfig, peers with the other side-cars over RemoteTransportConfig and routes the requests by
+// the route table given by -routes. The route table is reloaded on SIGHUP.
+//
+// The CONFIG_CENTER messages are answered by a local config center if -config-keys is given, it's a YAML file
+// mapping the service ids to their service keys. The values are kept in the JSON file given by -config-store,
+// or in memory if it's empty.
+//
+// Usage:
+//
+//	scrpc-sidecar [-config .scrpc.yml] [-routes routes.yml] [-config-keys keys.yml [-config-store config.json]]
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/victor-leee/scrpc"
+	"github.com/victor-leee/scrpc/configcenter"
+	"github.com/victor-leee/scrpc/sidecar"
+	"gopkg.in/yaml.v2"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func main() {
+	configFile := flag.String("config", scrpc.DefaultConfigFile, "scrpc configuration file, the environment is used if it doesn't exist")
+	routesFile := flag.String("routes", "", "route table file")
+	configKeysFile := flag.String("config-keys", "", "service keys of the local config center, it's disabled if empty")
+	configStoreFile := flag.String("config-store", "", "values of the local config center, they are kept in memory if empty")
+	flag.Parse()
+
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		logrus.Fatalf("[main] %v", err)
+	}
+	var table *sidecar.RouteTable
+	if *routesFile != "" {
+		if table, err = sidecar.LoadRouteTable(*routesFile); err != nil {
+			logrus.Fatalf("[main] %v", err)
+		}
+	}
+	proxyOpts := []sidecar.ProxyOpt{sidecar.WithPeerConfig(cfg), sidecar.WithRouteTable(table)}
+	if *configKeysFile != "" {
+		configCenter, configErr := newConfigCenter(*configKeysFile, *configStoreFile)
+		if configErr != nil {
+			logrus.Fatalf("[main] %v", configErr)
+		}
+		proxyOpts = append(proxyOpts, sidecar.WithConfigBackend(sidecar.ConfigService(configCenter)))
+	}
+	proxy := sidecar.NewProxy(proxyOpts...)
+
+	localCfg := cfg.LocalTransportConfig
+	if localCfg.Protocol == "unix" {
+		// the socket left by a previous run would fail the listener
+		if err = os.Remove(localCfg.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logrus.Fatalf("[main] remove stale socket %s failed: %v", localCfg.Path, err)
+		}
+	}
+	localLis, err := scrpc.Listen(localCfg.Protocol, localCfg.Path, scrpc.WithListenerType(scrpc.ConnTypeSideCar2Local),
+		scrpc.WithListenerConnOpts(cfg.ConnOpts(localCfg)...))
+	if err != nil {
+		logrus.Fatalf("[main] listen on %s failed: %v", localCfg.Path, err)
+	}
+	go serve(proxy, localLis)
+	if remoteCfg := cfg.RemoteTransportConfig; remoteCfg.Path != "" {
+		peerLis, listenErr := scrpc.Listen(remoteCfg.Protocol, remoteCfg.Path, scrpc.WithListenerType(scrpc.ConnTypeSideCar2SideCar),
+			scrpc.WithListenerConnOpts(cfg.ConnOpts(remoteCfg)...))
+		if listenErr != nil {
+			logrus.Fatalf("[main] listen on %s failed: %v", remoteCfg.Path, listenErr)
+		}
+		go serve(proxy, peerLis)
+	} else {
+		logrus.Warn("[main] RemoteTransportConfig.Path is empty, the peer side-cars can't reach this side-car")
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	for sig := range sigs {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		reloadRoutes(proxy, *routesFile)
+	}
+	if err = proxy.Close(); err != nil {
+		logrus.Warnf("[main] close proxy failed: %v", err)
+	}
+}
+
+// loadConfig resolves the configuration file at path, or the environment alone if the file doesn't exist
+func loadConfig(path string) (*scrpc.Config, error) {
+	explicit, err := scrpc.LoadConfigFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		logrus.Infof("[loadConfig] %s doesn't exist, the environment is used", path)
+		explicit, err = nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return scrpc.ResolveConfig(explicit)
+}
+
+// newConfigCenter builds the local config center of the service keys file and the store file
+func newConfigCenter(keysFile, storeFile string) (*configcenter.Service, error) {
+	b, err := os.ReadFile(keysFile)
+	if err != nil {
+		return nil, err
+	}
+	var keys map[string]string
+	if err = yaml.UnmarshalStrict(b, &keys); err != nil {
+		return nil, fmt.Errorf("parse %s failed: %w", keysFile, err)
+	}
+	store := configcenter.NewMemoryStore()
+	if storeFile != "" {
+		if store, err = configcenter.NewFileStore(storeFile); err != nil {
+			return nil, err
+		}
+	}
+
+	return configcenter.New(configcenter.WithServiceKeys(keys), configcenter.WithStore(store)), nil
+}
+
+func serve(proxy *sidecar.Proxy, lis *scrpc.Listener) {
+	logrus.Infof("[serve] listening on %s", lis.Addr())
+	if err := proxy.Serve(lis); err != nil && !errors.Is(err, sidecar.ErrProxyClosed) {
+		logrus.Fatalf("[serve] serve %s failed: %v", lis.Addr(), err)
+	}
+}
+
+func reloadRoutes(proxy *sidecar.Proxy, path string) {
+	if path == "" {
+		return
+	}
+	table, err := sidecar.LoadRouteTable(path)
+	if err == nil {
+		err = proxy.SetRouteTable(table)
+	}
+	if err != nil {
+		logrus.Errorf("[reloadRoutes] the current route table is kept: %v", err)
+		return
+	}
+	logrus.Infof("[reloadRoutes] %s reloaded", path)
+}
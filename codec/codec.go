@@ -0,0 +1,47 @@
+// Package codec provides the serializations of scrpc message bodies, a codec is selected by the name carried in Header
+package codec
+
+import (
+	"google.golang.org/protobuf/proto"
+	"sync"
+)
+
+// Codec serializes messages, implementations must be safe for concurrent use
+type Codec interface {
+	// Name is the name of the codec carried in Header.codec
+	Name() string
+	Marshal(m proto.Message) ([]byte, error)
+	Unmarshal(b []byte, m proto.Message) error
+}
+
+var (
+	mux    sync.RWMutex
+	codecs = make(map[string]Codec)
+)
+
+// Register makes c available under c.Name(), a codec registered with the same name is replaced
+func Register(c Codec) {
+	mux.Lock()
+	defer mux.Unlock()
+
+	codecs[c.Name()] = c
+}
+
+// Get returns the codec registered with name, the protobuf codec is returned for an empty name
+// and nil is returned if there is no such codec
+func Get(name string) Codec {
+	if name == "" {
+		name = Proto
+	}
+
+	mux.RLock()
+	defer mux.RUnlock()
+
+	return codecs[name]
+}
+
+func init() {
+	Register(protoCodec{})
+	Register(jsonCodec{})
+	Register(msgpackCodec{})
+}
@@ -0,0 +1,44 @@
+package codec
+
+import (
+	"encoding/json"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// MsgPack is the name of the MessagePack codec, messages are encoded as maps following the protobuf JSON mapping
+const MsgPack = "msgpack"
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string {
+	return MsgPack
+}
+
+func (msgpackCodec) Marshal(m proto.Message) ([]byte, error) {
+	// going through the JSON mapping keeps oneofs, enums and well-known types readable by non-Go peers
+	b, err := protojson.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	var v interface{}
+	if err = json.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+
+	return msgpack.Marshal(v)
+}
+
+func (msgpackCodec) Unmarshal(b []byte, m proto.Message) error {
+	var v interface{}
+	if err := msgpack.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	jsonBytes, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(jsonBytes, m)
+}
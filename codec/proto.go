@@ -0,0 +1,22 @@
+package codec
+
+import (
+	"google.golang.org/protobuf/proto"
+)
+
+// Proto is the name of the protobuf codec, it's the default codec
+const Proto = "proto"
+
+type protoCodec struct{}
+
+func (protoCodec) Name() string {
+	return Proto
+}
+
+func (protoCodec) Marshal(m proto.Message) ([]byte, error) {
+	return proto.Marshal(m)
+}
+
+func (protoCodec) Unmarshal(b []byte, m proto.Message) error {
+	return proto.Unmarshal(b, m)
+}
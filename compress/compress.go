@@ -0,0 +1,53 @@
+// Package compress provides the body compressors of scrpc, a compressor is selected by the name carried in Header
+package compress
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrTooLarge is returned by Decompress if the decompressed body exceeds its limit
+var ErrTooLarge = errors.New("decompressed body too large")
+
+// Compressor compresses and decompresses message bodies, implementations must be safe for concurrent use
+type Compressor interface {
+	// Name is the name of the compressor carried in Header.compression
+	Name() string
+	Compress(b []byte) ([]byte, error)
+	// Decompress decompresses b into at most maxSize bytes, it must stop as soon as the limit is exceeded
+	// and return an error wrapping ErrTooLarge
+	Decompress(b []byte, maxSize uint64) ([]byte, error)
+}
+
+func tooLarge(maxSize uint64) error {
+	return fmt.Errorf("%w: exceeds %d bytes", ErrTooLarge, maxSize)
+}
+
+var (
+	mux         sync.RWMutex
+	compressors = make(map[string]Compressor)
+)
+
+// Register makes c available under c.Name(), a compressor registered with the same name is replaced.
+// Peers must have registered the same compressors to understand each other
+func Register(c Compressor) {
+	mux.Lock()
+	defer mux.Unlock()
+
+	compressors[c.Name()] = c
+}
+
+// Get returns the compressor registered with name, or nil if there is none
+func Get(name string) Compressor {
+	mux.RLock()
+	defer mux.RUnlock()
+
+	return compressors[name]
+}
+
+func init() {
+	Register(&gzipCompressor{})
+	Register(newZstdCompressor())
+	Register(&snappyCompressor{})
+}
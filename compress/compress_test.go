@@ -0,0 +1,56 @@
+package compress
+
+import (
+	"bytes"
+	"errors"
+	"runtime"
+	"testing"
+)
+
+func TestDecompressRoundTrip(t *testing.T) {
+	body := bytes.Repeat([]byte("scrpc "), 1000)
+	for _, name := range []string{Gzip, Zstd, Snappy} {
+		c := Get(name)
+		compressed, err := c.Compress(body)
+		if err != nil {
+			t.Fatalf("%s: compress failed: %v", name, err)
+		}
+		// a body of exactly the limit is accepted
+		decompressed, err := c.Decompress(compressed, uint64(len(body)))
+		if err != nil {
+			t.Fatalf("%s: decompress failed: %v", name, err)
+		}
+		if !bytes.Equal(decompressed, body) {
+			t.Fatalf("%s: decompressed body differs", name)
+		}
+	}
+}
+
+// TestDecompressStopsAtLimit decompresses a highly compressible body far larger than the limit,
+// the compressors must fail without allocating the whole body
+func TestDecompressStopsAtLimit(t *testing.T) {
+	const (
+		bodySize = 64 << 20
+		maxSize  = 1 << 20
+	)
+	body := make([]byte, bodySize)
+	for _, name := range []string{Gzip, Zstd, Snappy} {
+		c := Get(name)
+		compressed, err := c.Compress(body)
+		if err != nil {
+			t.Fatalf("%s: compress failed: %v", name, err)
+		}
+
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		_, err = c.Decompress(compressed, maxSize)
+		runtime.ReadMemStats(&after)
+		if !errors.Is(err, ErrTooLarge) {
+			t.Fatalf("%s: got %v, expected ErrTooLarge", name, err)
+		}
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 8*maxSize {
+			t.Errorf("%s: allocated %d bytes to reject a body over %d bytes", name, allocated, maxSize)
+		}
+	}
+}
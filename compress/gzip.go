@@ -0,0 +1,63 @@
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"math"
+	"sync"
+)
+
+// Gzip is the name of the gzip compressor
+const Gzip = "gzip"
+
+type gzipCompressor struct {
+	writers sync.Pool
+}
+
+func (g *gzipCompressor) Name() string {
+	return Gzip
+}
+
+func (g *gzipCompressor) Compress(b []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w, ok := g.writers.Get().(*gzip.Writer)
+	if ok {
+		w.Reset(buf)
+	} else {
+		w = gzip.NewWriter(buf)
+	}
+	defer g.writers.Put(w)
+
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (g *gzipCompressor) Decompress(b []byte, maxSize uint64) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	// one byte past the limit tells an oversized body from one of exactly maxSize bytes
+	limit := int64(math.MaxInt64)
+	if maxSize < math.MaxInt64 {
+		limit = int64(maxSize) + 1
+	}
+	decompressed, err := io.ReadAll(io.LimitReader(r, limit))
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(decompressed)) > maxSize {
+		return nil, tooLarge(maxSize)
+	}
+
+	return decompressed, nil
+}
@@ -0,0 +1,31 @@
+package compress
+
+import (
+	"github.com/golang/snappy"
+)
+
+// Snappy is the name of the snappy compressor
+const Snappy = "snappy"
+
+type snappyCompressor struct{}
+
+func (s *snappyCompressor) Name() string {
+	return Snappy
+}
+
+func (s *snappyCompressor) Compress(b []byte) ([]byte, error) {
+	return snappy.Encode(nil, b), nil
+}
+
+func (s *snappyCompressor) Decompress(b []byte, maxSize uint64) ([]byte, error) {
+	// the decoded length is encoded in the block, so an oversized body is rejected before allocating it
+	n, err := snappy.DecodedLen(b)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(n) > maxSize {
+		return nil, tooLarge(maxSize)
+	}
+
+	return snappy.Decode(nil, b)
+}
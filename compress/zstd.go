@@ -0,0 +1,71 @@
+package compress
+
+import (
+	"errors"
+	"github.com/klauspost/compress/zstd"
+	"sync"
+)
+
+// Zstd is the name of the zstd compressor
+const Zstd = "zstd"
+
+// maxZstdDecodedSize is the largest limit a zstd decoder accepts
+const maxZstdDecodedSize = 1 << 63
+
+type zstdCompressor struct {
+	encoder *zstd.Encoder
+	// decoders holds a *zstd.Decoder per limit of the decompressed size, there are as many as distinct
+	// limits are configured
+	decoders sync.Map
+}
+
+func newZstdCompressor() *zstdCompressor {
+	// it doesn't fail without options, EncodeAll is safe for concurrent use
+	encoder, _ := zstd.NewWriter(nil)
+
+	return &zstdCompressor{
+		encoder: encoder,
+	}
+}
+
+func (z *zstdCompressor) Name() string {
+	return Zstd
+}
+
+func (z *zstdCompressor) Compress(b []byte) ([]byte, error) {
+	return z.encoder.EncodeAll(b, nil), nil
+}
+
+func (z *zstdCompressor) Decompress(b []byte, maxSize uint64) ([]byte, error) {
+	decoder, err := z.decoder(maxSize)
+	if err != nil {
+		return nil, err
+	}
+	decompressed, err := decoder.DecodeAll(b, nil)
+	// frames whose window exceeds the limit are rejected as well
+	if errors.Is(err, zstd.ErrDecoderSizeExceeded) || errors.Is(err, zstd.ErrWindowSizeExceeded) {
+		return nil, tooLarge(maxSize)
+	}
+
+	return decompressed, err
+}
+
+// decoder returns the decoder stopping at maxSize bytes, DecodeAll is safe for concurrent use
+func (z *zstdCompressor) decoder(maxSize uint64) (*zstd.Decoder, error) {
+	if maxSize > maxZstdDecodedSize {
+		maxSize = maxZstdDecodedSize
+	}
+	if d, ok := z.decoders.Load(maxSize); ok {
+		return d.(*zstd.Decoder), nil
+	}
+	decoder, err := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxSize))
+	if err != nil {
+		return nil, err
+	}
+	if d, loaded := z.decoders.LoadOrStore(maxSize, decoder); loaded {
+		decoder.Close()
+		return d.(*zstd.Decoder), nil
+	}
+
+	return decoder, nil
+}
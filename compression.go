@@ -0,0 +1,66 @@
+package scrpc
+
+import (
+	"errors"
+	"fmt"
+	"github.com/victor-leee/scrpc/compress"
+	"github.com/victor-leee/scrpc/github.com/victor-leee/scrpc"
+)
+
+// DefaultCompressThreshold is the body size in bytes from which bodies are compressed
+const DefaultCompressThreshold = 1024
+
+// compression selects how outbound bodies are compressed, the zero value disables compression
+type compression struct {
+	name      string
+	threshold int
+}
+
+// responseCompression is the compression of the answers to a request with header, it follows the compressor
+// selected by the caller and falls back to no compression if the compressor is unknown
+func responseCompression(header *scrpc.Header, threshold int) compression {
+	if compress.Get(header.Compression) == nil {
+		return compression{}
+	}
+
+	return compression{
+		name:      header.Compression,
+		threshold: threshold,
+	}
+}
+
+// apply records the selected compressor in header and compresses body if it reaches the threshold
+func (c compression) apply(body []byte, header *scrpc.Header) ([]byte, error) {
+	if c.name == "" {
+		return body, nil
+	}
+	compressor := compress.Get(c.name)
+	if compressor == nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownCompressor, c.name)
+	}
+	header.Compression = c.name
+	if len(body) < c.threshold {
+		return body, nil
+	}
+	compressed, err := compressor.Compress(body)
+	if err != nil {
+		return nil, err
+	}
+	header.Compressed = true
+
+	return compressed, nil
+}
+
+// decompressBody decompresses body into at most maxSize bytes, ErrMessageTooLarge is returned if it's larger
+func decompressBody(name string, body []byte, maxSize uint64) ([]byte, error) {
+	compressor := compress.Get(name)
+	if compressor == nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownCompressor, name)
+	}
+	decompressed, err := compressor.Decompress(body, maxSize)
+	if errors.Is(err, compress.ErrTooLarge) {
+		return nil, fmt.Errorf("%w: decompressed body exceeds %d bytes", ErrMessageTooLarge, maxSize)
+	}
+
+	return decompressed, err
+}
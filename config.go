@@ -1,11 +1,18 @@
 package scrpc
 
 import (
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type PoolConfig struct {
+	// InitSize is the number of connections dialed in advance, it's taken as is once PoolCfg is set
 	InitSize int
 	MaxSize  int
 }
@@ -14,48 +21,540 @@ type TransportConfig struct {
 	Protocol string
 	Path     string
 	PoolCfg  *PoolConfig
+	// Handshake starts the protocol handshake on new connections, the peers must support it. Without it the features
+	// of the peers are unknown and checksums are never used. Nil takes the environment, false overrides it
+	Handshake *bool
+	// Checksum appends a CRC32C trailer to the frames written if the peer supports it. Nil takes the environment,
+	// false overrides it
+	Checksum *bool
 }
 
+// TimeoutConfig holds the timeouts of clients and servers. Nil takes the environment, zero means no timeout
+type TimeoutConfig struct {
+	// Dial bounds the establishment of a connection
+	Dial *time.Duration
+	// Handshake bounds the protocol handshake of a new connection
+	Handshake *time.Duration
+	// Request bounds a unary or batch request from writing it to reading its response
+	Request *time.Duration
+}
+
+// GetDial returns the dial timeout, zero if it's unset
+func (t *TimeoutConfig) GetDial() time.Duration {
+	return valueOf(t.Dial)
+}
+
+// GetHandshake returns the handshake timeout, zero if it's unset
+func (t *TimeoutConfig) GetHandshake() time.Duration {
+	return valueOf(t.Handshake)
+}
+
+// GetRequest returns the request timeout, zero if it's unset
+func (t *TimeoutConfig) GetRequest() time.Duration {
+	return valueOf(t.Request)
+}
+
+// Bool returns a pointer to b, to set the optional flags of a Config
+func Bool(b bool) *bool {
+	return &b
+}
+
+// Timeout returns a pointer to d, to set the fields of TimeoutConfig
+func Timeout(d time.Duration) *time.Duration {
+	return &d
+}
+
+func valueOf[T any](v *T) T {
+	var zero T
+	if v == nil {
+		return zero
+	}
+
+	return *v
+}
+
+// LimitConfig holds the limits of clients and servers
+type LimitConfig struct {
+	// MaxHeaderSize and MaxBodySize limit the size of the messages read
+	MaxHeaderSize uint64
+	MaxBodySize   uint64
+	// MaxInFlight is the number of asynchronous requests a client runs concurrently
+	MaxInFlight int
+}
+
+// RetryPolicy retries the unary requests failing with ErrThrottled or failing to connect
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts including the first one
+	MaxAttempts int
+	// Backoff is the wait before the first retry, it doubles on every retry up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// ServicePolicy is the policy of the requests to a receiver service
+type ServicePolicy struct {
+	// Timeout overrides Timeouts.Request for the service if it's positive
+	Timeout time.Duration
+	Retry   *RetryPolicy
+}
+
+// TransportMode selects how clients and servers reach their peers
+type TransportMode string
+
+const (
+	// TransportSideCar routes every message through the local side-car over LocalTransportConfig
+	TransportSideCar TransportMode = "side-car"
+	// TransportRemote makes the process act as its own side-car over RemoteTransportConfig: clients dial the
+	// side-cars of the receiver services listed in Config.Peers and servers listen on RemoteTransportConfig.Path
+	TransportRemote TransportMode = "remote"
+)
+
+// Config is the configuration of clients and servers, it's passed by WithConfig and WithServerConfig.
+// Unset fields are filled by DefaultConfig, so the environment is only a defaulting layer. A field is unset if
+// it's nil, or if it's zero while zero is not a valid value, like a path, a size or a limit. Fields where zero
+// is meaningful, like timeouts and flags, are pointers so that an explicit zero overrides the environment
 type Config struct {
 	LocalTransportConfig  *TransportConfig
 	RemoteTransportConfig *TransportConfig
+	Timeouts              *TimeoutConfig
+	Limits                *LimitConfig
+	// Mode is TransportSideCar by default
+	Mode TransportMode
+	// Peers holds the addresses of the side-cars of the receiver services keyed by their name, they are
+	// dialed in TransportRemote mode
+	Peers map[string]string
+	// Services holds the policies of the receiver services keyed by their name
+	Services map[string]*ServicePolicy
 }
 
+// servicePolicy returns the policy of service, nil if it has none
+func (c *Config) servicePolicy(service string) *ServicePolicy {
+	return c.Services[service]
+}
+
+// requestTimeout is the timeout of the requests to service
+func (c *Config) requestTimeout(service string) time.Duration {
+	if policy := c.servicePolicy(service); policy != nil && policy.Timeout > 0 {
+		return policy.Timeout
+	}
+
+	return c.Timeouts.GetRequest()
+}
+
+// peer returns the address of the side-car of service
+func (c *Config) peer(service string) (string, error) {
+	addr, ok := c.Peers[service]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrUnknownPeer, service)
+	}
+
+	return addr, nil
+}
+
+// transport returns the transport the clients dial in the mode of c
+func (c *Config) transport() *TransportConfig {
+	if c.Mode == TransportRemote {
+		return c.RemoteTransportConfig
+	}
+
+	return c.LocalTransportConfig
+}
+
+// connType returns the type of the connections the clients dial in the mode of c
+func (c *Config) connType() string {
+	if c.Mode == TransportRemote {
+		return ConnTypeSideCar2SideCar
+	}
+
+	return ConnTypeSideCar2Local
+}
+
+// ErrInvalidConfig is returned if a Config doesn't pass Validate
+var ErrInvalidConfig = errors.New("invalid config")
+
 var cfg *Config
 
 func init() {
-	cfg = &Config{
+	var err error
+	if cfg, err = DefaultConfig(); err != nil {
+		logrus.Errorf("[init] %v, built-in defaults are used instead", err)
+	}
+}
+
+// GetConfig returns the configuration built from the environment when the package was loaded
+func GetConfig() *Config {
+	return cfg
+}
+
+// builtinConfig is the configuration used when neither the caller nor the environment set a value
+func builtinConfig() *Config {
+	return &Config{
 		LocalTransportConfig: &TransportConfig{
-			Protocol: env("__SCRPC_LOCAL_TRANSPORT_CONFIG_PROTO", "unix"),
-			Path:     env("__SCRPC_LOCAL_TRANSPORT_CONFIG_PATH", "/tmp/sc.sock"),
+			Protocol: "unix",
+			Path:     "/tmp/sc.sock",
 			PoolCfg: &PoolConfig{
-				InitSize: str2Int(env("__SCRPC_LOCAL_TRANSPORT_CONFIG_POOL_INIT_SIZE", "10")),
-				MaxSize:  str2Int(env("__SCRPC_LOCAL_TRANSPORT_CONFIG_POOL_MAX_SIZE", "50")),
+				InitSize: 10,
+				MaxSize:  50,
 			},
+			Handshake: Bool(false),
+			Checksum:  Bool(false),
 		},
 		RemoteTransportConfig: &TransportConfig{
-			Protocol: env("__SCRPC_REMOTE_TRANSPORT_CONFIG_PROTO", "tcp"),
+			Protocol: "tcp",
 			PoolCfg: &PoolConfig{
-				InitSize: str2Int(env("__SCRPC_REMOTE_TRANSPORT_CONFIG_POOL_INIT_SIZE", "10")),
-				MaxSize:  str2Int(env("__SCRPC_REMOTE_TRANSPORT_CONFIG_POOL_MAX_SIZE", "50")),
+				InitSize: 10,
+				MaxSize:  50,
 			},
+			Handshake: Bool(false),
+			Checksum:  Bool(false),
+		},
+		Timeouts: &TimeoutConfig{
+			Dial:      Timeout(0),
+			Handshake: Timeout(handshakeTimeout),
+			Request:   Timeout(0),
+		},
+		Mode: TransportSideCar,
+		Limits: &LimitConfig{
+			MaxHeaderSize: DefaultMaxHeaderSize,
+			MaxBodySize:   DefaultMaxBodySize,
+			MaxInFlight:   DefaultMaxInFlight,
 		},
 	}
 }
 
-func GetConfig() *Config {
-	return cfg
+// DefaultConfig returns the built-in configuration overridden by the __SCRPC_* environment variables.
+// Invalid variables are reported by the returned error and their built-in default is kept
+func DefaultConfig() (*Config, error) {
+	c, errs := envConfig()
+	if len(errs) > 0 {
+		return c, invalidConfig(errs)
+	}
+
+	return c, nil
+}
+
+// envConfig is DefaultConfig returning the invalid variables one by one
+func envConfig() (*Config, []error) {
+	c := builtinConfig()
+	p := &envParser{}
+	p.transport("__SCRPC_LOCAL_TRANSPORT_CONFIG_", c.LocalTransportConfig)
+	p.transport("__SCRPC_REMOTE_TRANSPORT_CONFIG_", c.RemoteTransportConfig)
+	p.duration("__SCRPC_DIAL_TIMEOUT", c.Timeouts.Dial)
+	p.duration("__SCRPC_HANDSHAKE_TIMEOUT", c.Timeouts.Handshake)
+	p.duration("__SCRPC_REQUEST_TIMEOUT", c.Timeouts.Request)
+	p.uint("__SCRPC_MAX_HEADER_SIZE", &c.Limits.MaxHeaderSize)
+	p.uint("__SCRPC_MAX_BODY_SIZE", &c.Limits.MaxBodySize)
+	p.int("__SCRPC_MAX_IN_FLIGHT", &c.Limits.MaxInFlight)
+	p.string("__SCRPC_TRANSPORT_MODE", (*string)(&c.Mode))
+	p.peers("__SCRPC_PEERS", &c.Peers)
+
+	return c, p.errs
+}
+
+// envParser overrides values by the environment variables which are set, collecting the invalid ones
+type envParser struct {
+	errs []error
+}
+
+func (p *envParser) transport(prefix string, t *TransportConfig) {
+	p.string(prefix+"PROTO", &t.Protocol)
+	p.string(prefix+"PATH", &t.Path)
+	p.int(prefix+"POOL_INIT_SIZE", &t.PoolCfg.InitSize)
+	p.int(prefix+"POOL_MAX_SIZE", &t.PoolCfg.MaxSize)
+	p.bool(prefix+"HANDSHAKE", t.Handshake)
+	p.bool(prefix+"CHECKSUM", t.Checksum)
+}
+
+func (p *envParser) string(key string, v *string) {
+	if s, ok := os.LookupEnv(key); ok {
+		*v = s
+	}
 }
 
-func env(key, fallback string) string {
-	if v, ok := os.LookupEnv(key); ok {
-		return v
+// peers parses a comma-separated list of service=address
+func (p *envParser) peers(key string, v *map[string]string) {
+	p.parse(key, func(s string) error {
+		peers := make(map[string]string)
+		for _, peer := range strings.Split(s, ",") {
+			if peer = strings.TrimSpace(peer); peer == "" {
+				continue
+			}
+			service, addr, ok := strings.Cut(peer, "=")
+			if !ok {
+				return fmt.Errorf("%q is not service=address", peer)
+			}
+			peers[strings.TrimSpace(service)] = strings.TrimSpace(addr)
+		}
+		*v = peers
+		return nil
+	})
+}
+
+func (p *envParser) parse(key string, parse func(s string) error) {
+	s, ok := os.LookupEnv(key)
+	if !ok {
+		return
+	}
+	if err := parse(s); err != nil {
+		p.errs = append(p.errs, fmt.Errorf("%s=%q: %w", key, s, err))
+	}
+}
+
+func (p *envParser) int(key string, v *int) {
+	p.parse(key, func(s string) error {
+		i, err := strconv.Atoi(s)
+		if err == nil {
+			*v = i
+		}
+		return err
+	})
+}
+
+func (p *envParser) uint(key string, v *uint64) {
+	p.parse(key, func(s string) error {
+		u, err := strconv.ParseUint(s, 10, 64)
+		if err == nil {
+			*v = u
+		}
+		return err
+	})
+}
+
+// bool and duration set the values pointed by v, which must not be nil
+func (p *envParser) bool(key string, v *bool) {
+	p.parse(key, func(s string) error {
+		b, err := strconv.ParseBool(s)
+		if err == nil {
+			*v = b
+		}
+		return err
+	})
+}
+
+func (p *envParser) duration(key string, v *time.Duration) {
+	p.parse(key, func(s string) error {
+		d, err := time.ParseDuration(s)
+		if err == nil {
+			*v = d
+		}
+		return err
+	})
+}
+
+// withDefaults returns a copy of c whose unset fields are taken from def
+func (c *Config) withDefaults(def *Config) *Config {
+	merged := &Config{
+		LocalTransportConfig:  def.LocalTransportConfig,
+		RemoteTransportConfig: def.RemoteTransportConfig,
+		Timeouts:              def.Timeouts,
+		Limits:                def.Limits,
+		Mode:                  def.Mode,
+		Peers:                 def.Peers,
+		Services:              def.Services,
+	}
+	if c.Mode != "" {
+		merged.Mode = c.Mode
+	}
+	if c.Peers != nil {
+		merged.Peers = c.Peers
+	}
+	if c.Services != nil {
+		merged.Services = c.Services
+	}
+	if c.LocalTransportConfig != nil {
+		merged.LocalTransportConfig = c.LocalTransportConfig.withDefaults(def.LocalTransportConfig)
+	}
+	if c.RemoteTransportConfig != nil {
+		merged.RemoteTransportConfig = c.RemoteTransportConfig.withDefaults(def.RemoteTransportConfig)
+	}
+	if c.Timeouts != nil {
+		merged.Timeouts = &TimeoutConfig{
+			Dial:      orDefault(c.Timeouts.Dial, def.Timeouts.Dial),
+			Handshake: orDefault(c.Timeouts.Handshake, def.Timeouts.Handshake),
+			Request:   orDefault(c.Timeouts.Request, def.Timeouts.Request),
+		}
+	}
+	if c.Limits != nil {
+		l := *c.Limits
+		setDefault(&l.MaxHeaderSize, def.Limits.MaxHeaderSize)
+		setDefault(&l.MaxBodySize, def.Limits.MaxBodySize)
+		setDefault(&l.MaxInFlight, def.Limits.MaxInFlight)
+		merged.Limits = &l
 	}
 
-	return fallback
+	return merged
 }
 
-func str2Int(str string) int {
-	v, _ := strconv.ParseInt(str, 10, 64)
-	return int(v)
+func (t *TransportConfig) withDefaults(def *TransportConfig) *TransportConfig {
+	merged := *t
+	setDefault(&merged.Protocol, def.Protocol)
+	setDefault(&merged.Path, def.Path)
+	merged.Handshake = orDefault(t.Handshake, def.Handshake)
+	merged.Checksum = orDefault(t.Checksum, def.Checksum)
+	if t.PoolCfg == nil {
+		merged.PoolCfg = def.PoolCfg
+	} else {
+		// zero is a valid InitSize, the pool dials no connection in advance
+		pool := *t.PoolCfg
+		setDefault(&pool.MaxSize, def.PoolCfg.MaxSize)
+		merged.PoolCfg = &pool
+	}
+
+	return &merged
+}
+
+// setDefault sets the fields whose zero value is invalid
+func setDefault[T comparable](v *T, def T) {
+	var zero T
+	if *v == zero {
+		*v = def
+	}
+}
+
+// orDefault merges the fields whose zero value is meaningful, they are unset only if nil
+func orDefault[T any](v, def *T) *T {
+	if v == nil {
+		return def
+	}
+
+	return v
+}
+
+// Validate checks every value of the configuration, the returned error wraps ErrInvalidConfig and describes
+// all the invalid values
+func (c *Config) Validate() error {
+	if errs := c.validate(); len(errs) > 0 {
+		return invalidConfig(errs)
+	}
+
+	return nil
+}
+
+// validate returns the invalid values of the configuration
+func (c *Config) validate() []error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	transports := []struct {
+		name string
+		t    *TransportConfig
+	}{
+		{"LocalTransportConfig", c.LocalTransportConfig},
+		{"RemoteTransportConfig", c.RemoteTransportConfig},
+	}
+	for _, transport := range transports {
+		name, t := transport.name, transport.t
+		if t == nil {
+			errs = append(errs, fmt.Errorf("%s is missing", name))
+			continue
+		}
+		check(isSupportedNetwork(t.Protocol), "%s.Protocol %q is not one of tcp, tcp4, tcp6 and unix", name, t.Protocol)
+		if t.PoolCfg == nil {
+			errs = append(errs, fmt.Errorf("%s.PoolCfg is missing", name))
+			continue
+		}
+		check(t.PoolCfg.MaxSize > 0, "%s.PoolCfg.MaxSize must be positive, got %d", name, t.PoolCfg.MaxSize)
+		check(t.PoolCfg.InitSize >= 0, "%s.PoolCfg.InitSize must not be negative, got %d", name, t.PoolCfg.InitSize)
+		check(t.PoolCfg.InitSize <= t.PoolCfg.MaxSize, "%s.PoolCfg.InitSize %d exceeds MaxSize %d",
+			name, t.PoolCfg.InitSize, t.PoolCfg.MaxSize)
+	}
+	if c.LocalTransportConfig != nil {
+		check(c.LocalTransportConfig.Path != "", "LocalTransportConfig.Path is empty")
+	}
+	if c.Timeouts == nil {
+		errs = append(errs, errors.New("Timeouts is missing"))
+	} else {
+		check(c.Timeouts.GetDial() >= 0, "Timeouts.Dial must not be negative, got %v", c.Timeouts.GetDial())
+		check(c.Timeouts.GetHandshake() >= 0, "Timeouts.Handshake must not be negative, got %v", c.Timeouts.GetHandshake())
+		check(c.Timeouts.GetRequest() >= 0, "Timeouts.Request must not be negative, got %v", c.Timeouts.GetRequest())
+	}
+	if c.Limits == nil {
+		errs = append(errs, errors.New("Limits is missing"))
+	} else {
+		check(c.Limits.MaxHeaderSize > 0, "Limits.MaxHeaderSize must be positive")
+		check(c.Limits.MaxBodySize > 0, "Limits.MaxBodySize must be positive")
+		check(c.Limits.MaxInFlight > 0, "Limits.MaxInFlight must be positive, got %d", c.Limits.MaxInFlight)
+	}
+	check(c.Mode == TransportSideCar || c.Mode == TransportRemote, "Mode %q is not one of %s and %s",
+		c.Mode, TransportSideCar, TransportRemote)
+	for _, service := range sortedKeys(c.Peers) {
+		check(c.Peers[service] != "", "Peers[%s] is empty", service)
+	}
+	for _, service := range sortedKeys(c.Services) {
+		policy := c.Services[service]
+		if policy == nil {
+			continue
+		}
+		check(policy.Timeout >= 0, "Services[%s].Timeout must not be negative, got %v", service, policy.Timeout)
+		if retry := policy.Retry; retry != nil {
+			check(retry.MaxAttempts > 0, "Services[%s].Retry.MaxAttempts must be positive, got %d", service, retry.MaxAttempts)
+			check(retry.Backoff >= 0, "Services[%s].Retry.Backoff must not be negative, got %v", service, retry.Backoff)
+			check(retry.MaxBackoff >= 0, "Services[%s].Retry.MaxBackoff must not be negative, got %v", service, retry.MaxBackoff)
+		}
+	}
+
+	return errs
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+func invalidConfig(errs []error) error {
+	msgs := make([]string, 0, len(errs))
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+
+	return fmt.Errorf("%w: %s", ErrInvalidConfig, strings.Join(msgs, "; "))
+}
+
+func isSupportedNetwork(network string) bool {
+	switch network {
+	case "tcp", "tcp4", "tcp6", "unix":
+		return true
+	default:
+		return false
+	}
+}
+
+// ResolveConfig merges explicit with the environment and validates the result, explicit may be nil.
+// The returned error describes the invalid environment variables as well as the invalid values, even if
+// explicit overrides the variables
+func ResolveConfig(explicit *Config) (*Config, error) {
+	def, errs := envConfig()
+	resolved := def
+	if explicit != nil {
+		resolved = explicit.withDefaults(def)
+	}
+	if errs = append(errs, resolved.validate()...); len(errs) > 0 {
+		return resolved, invalidConfig(errs)
+	}
+
+	return resolved, nil
+}
+
+// ConnOpts are the options of the connections over the transport t, reading messages within the limits of c
+func (c *Config) ConnOpts(t *TransportConfig) []ConnOpt {
+	return c.dialOpts(t, []ReadOpt{MaxHeaderSize(c.Limits.MaxHeaderSize), MaxBodySize(c.Limits.MaxBodySize)})
+}
+
+// dialOpts are the options of the connections to the transport t
+func (c *Config) dialOpts(t *TransportConfig, readOpts []ReadOpt) []ConnOpt {
+	return []ConnOpt{
+		WithReadOpts(readOpts...),
+		WithHandshake(valueOf(t.Handshake)),
+		WithHandshakeTimeout(c.Timeouts.GetHandshake()),
+		WithChecksum(valueOf(t.Checksum)),
+	}
 }
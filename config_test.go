@@ -0,0 +1,36 @@
+package scrpc
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestInvalidEnvFailsConstructors(t *testing.T) {
+	t.Setenv("__SCRPC_REQUEST_TIMEOUT", "soon")
+	// the explicit timeout doesn't hide the invalid variable
+	explicit := &Config{
+		Timeouts: &TimeoutConfig{Request: Timeout(0)},
+	}
+
+	if _, err := ResolveConfig(explicit); !errors.Is(err, ErrInvalidConfig) || !strings.Contains(err.Error(), "__SCRPC_REQUEST_TIMEOUT") {
+		t.Errorf("ResolveConfig got %v, expected the invalid variable", err)
+	}
+	client, err := NewClient(WithConfig(explicit))
+	if !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("NewClient got %v, expected ErrInvalidConfig", err)
+	}
+	if err = client.Close(); err != nil {
+		t.Errorf("close client failed: %v", err)
+	}
+	server, err := NewServer("greeter", WithServerConfig(explicit))
+	if !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("NewServer got %v, expected ErrInvalidConfig", err)
+	}
+	if err = server.Start(); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Start got %v, expected ErrInvalidConfig", err)
+	}
+	if err = server.Close(); err != nil {
+		t.Errorf("close server failed: %v", err)
+	}
+}
@@ -0,0 +1,157 @@
+package configcenter
+
+import (
+	"context"
+	config_backend "github.com/victor-leee/scrpc/github.com/victor-leee/config-backend"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestServiceAuthenticates(t *testing.T) {
+	s := New(WithServiceKeys(map[string]string{"svc": "secret"}))
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		id, key string
+		code    config_backend.ErrorCode
+	}{
+		{name: "valid", id: "svc", key: "secret", code: config_backend.ErrorCode_SUCCESS},
+		{name: "unknown id", id: "other", key: "secret", code: config_backend.ErrorCode_ERR_INVALID_SERVICE_ID},
+		{name: "empty id", id: "", key: "", code: config_backend.ErrorCode_ERR_INVALID_SERVICE_ID},
+		{name: "wrong key", id: "svc", key: "secreT", code: config_backend.ErrorCode_ERR_INVALID_SERVICE_KEY},
+		{name: "key prefix", id: "svc", key: "secre", code: config_backend.ErrorCode_ERR_INVALID_SERVICE_KEY},
+		{name: "longer key", id: "svc", key: "secret!", code: config_backend.ErrorCode_ERR_INVALID_SERVICE_KEY},
+		{name: "empty key", id: "svc", key: "", code: config_backend.ErrorCode_ERR_INVALID_SERVICE_KEY},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			put, _ := s.PutConfig(ctx, &config_backend.PutConfigRequest{ServiceId: tt.id, ServiceKey: tt.key, Key: "k", Value: "v"})
+			get, _ := s.GetConfig(ctx, &config_backend.GetConfigRequest{ServiceId: tt.id, ServiceKey: tt.key, Key: "k"})
+			keys, _ := s.GetAllKeys(ctx, &config_backend.GetAllKeysRequest{ServiceId: tt.id, ServiceKey: tt.key})
+			for method, base := range map[string]*config_backend.BaseResponse{
+				"PutConfig":  put.GetBaseResponse(),
+				"GetConfig":  get.GetBaseResponse(),
+				"GetAllKeys": keys.GetBaseResponse(),
+			} {
+				if base.GetErrCode() != tt.code {
+					t.Errorf("%s got %s, expected %s", method, base.GetErrCode(), tt.code)
+				}
+			}
+		})
+	}
+
+	// a registered key is replaced
+	s.RegisterService("svc", "rotated")
+	get, _ := s.GetConfig(ctx, &config_backend.GetConfigRequest{ServiceId: "svc", ServiceKey: "secret", Key: "k"})
+	if code := get.GetBaseResponse().GetErrCode(); code != config_backend.ErrorCode_ERR_INVALID_SERVICE_KEY {
+		t.Errorf("got %s with the replaced key, expected ERR_INVALID_SERVICE_KEY", code)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	s := NewMemoryStore()
+
+	for _, key := range []string{"b", "a", "c"} {
+		if err := s.Put("svc", key, "value of "+key); err != nil {
+			t.Fatalf("put %s failed: %v", key, err)
+		}
+	}
+	if err := s.Put("other", "z", "hidden"); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+	if value, ok, err := s.Get("svc", "a"); err != nil || !ok || value != "value of a" {
+		t.Errorf("got %q, %t, %v, expected the value of a", value, ok, err)
+	}
+	// the values of each service are separate
+	if _, ok, err := s.Get("svc", "z"); err != nil || ok {
+		t.Errorf("got %t, %v for the key of another service, expected none", ok, err)
+	}
+	if keys, err := s.Keys("svc"); err != nil || !reflect.DeepEqual(keys, []string{"a", "b", "c"}) {
+		t.Errorf("got keys %v, %v, expected them sorted", keys, err)
+	}
+	if keys, err := s.Keys("nobody"); err != nil || len(keys) != 0 {
+		t.Errorf("got keys %v, %v for an unknown service, expected none", keys, err)
+	}
+}
+
+func TestFileStoreReloads(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	s, err := NewFileStore(path)
+	if err != nil {
+		t.Fatalf("create store failed: %v", err)
+	}
+	if err = s.Put("svc", "k", "v1"); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+	if err = s.Put("svc", "k", "v2"); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+
+	reloaded, err := NewFileStore(path)
+	if err != nil {
+		t.Fatalf("reload store failed: %v", err)
+	}
+	if value, ok, err := reloaded.Get("svc", "k"); err != nil || !ok || value != "v2" {
+		t.Errorf("got %q, %t, %v after reload, expected v2", value, ok, err)
+	}
+	assertNoTempFiles(t, filepath.Dir(path))
+}
+
+func TestFileStoreRejectsInvalidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{"svc": `), 0o600); err != nil {
+		t.Fatalf("write file failed: %v", err)
+	}
+
+	if _, err := NewFileStore(path); err == nil {
+		t.Fatal("got no error for a truncated file")
+	}
+}
+
+func TestFileStoreFailedWrite(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.json")
+	s, err := NewFileStore(path)
+	if err != nil {
+		t.Fatalf("create store failed: %v", err)
+	}
+	if err = s.Put("svc", "k", "v1"); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+	// the temporary file is written but can't replace a non-empty directory
+	if err = os.Remove(path); err != nil {
+		t.Fatalf("remove file failed: %v", err)
+	}
+	if err = os.MkdirAll(filepath.Join(path, "blocker"), 0o700); err != nil {
+		t.Fatalf("create directory failed: %v", err)
+	}
+
+	if err = s.Put("svc", "k", "v2"); err == nil {
+		t.Fatal("got no error replacing a directory")
+	}
+	if err = s.Put("svc", "new", "v"); err == nil {
+		t.Fatal("got no error replacing a directory")
+	}
+	// the memory follows the file, the failed writes left nothing behind
+	if value, ok, err := s.Get("svc", "k"); err != nil || !ok || value != "v1" {
+		t.Errorf("got %q, %t, %v after the failed write, expected v1", value, ok, err)
+	}
+	if _, ok, err := s.Get("svc", "new"); err != nil || ok {
+		t.Errorf("got %t, %v for the key whose write failed, expected none", ok, err)
+	}
+	assertNoTempFiles(t, dir)
+}
+
+func assertNoTempFiles(t *testing.T, dir string) {
+	t.Helper()
+	tmps, err := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	if err != nil {
+		t.Fatalf("list temporary files failed: %v", err)
+	}
+	if len(tmps) != 0 {
+		t.Errorf("temporary files left behind: %v", tmps)
+	}
+}
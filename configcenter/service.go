@@ -0,0 +1,142 @@
+// Package configcenter implements the config backend service locally, it stands in for the KV cluster behind
+// the CONFIG_CENTER messages in side-cars and tests:
+//
+//	svc := configcenter.New(configcenter.WithServiceKeys(map[string]string{"my-service": "secret"}))
+//	proxy := sidecar.NewProxy(sidecar.WithConfigBackend(sidecar.ConfigService(svc)))
+package configcenter
+
+import (
+	"context"
+	"crypto/subtle"
+	"github.com/sirupsen/logrus"
+	config_backend "github.com/victor-leee/scrpc/github.com/victor-leee/config-backend"
+	"sync"
+)
+
+// Service implements config_backend.ConfigBackendService over a Store. Every request is authenticated by its
+// service_id and service_key, the failures are reported by the error code of the base response
+type Service struct {
+	store Store
+
+	mux  sync.RWMutex
+	keys map[string]string
+}
+
+var _ config_backend.ConfigBackendService = (*Service)(nil)
+
+type Opt func(s *Service)
+
+// WithStore keeps the values in store, they are kept in memory by default
+func WithStore(store Store) Opt {
+	return func(s *Service) {
+		s.store = store
+	}
+}
+
+// WithServiceKeys registers the services allowed to use the service keyed by id, the values are their service keys
+func WithServiceKeys(keys map[string]string) Opt {
+	return func(s *Service) {
+		for id, key := range keys {
+			s.keys[id] = key
+		}
+	}
+}
+
+func New(opts ...Opt) *Service {
+	s := &Service{
+		store: NewMemoryStore(),
+		keys:  make(map[string]string),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+// RegisterService allows the service id authenticated by key to use the service, a registered key is replaced
+func (s *Service) RegisterService(id, key string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.keys[id] = key
+}
+
+// authenticate returns the base response of a request failing authentication, nil if it succeeds
+func (s *Service) authenticate(id, key string) *config_backend.BaseResponse {
+	s.mux.RLock()
+	expected, ok := s.keys[id]
+	s.mux.RUnlock()
+
+	if id == "" || !ok {
+		return &config_backend.BaseResponse{
+			ErrCode: config_backend.ErrorCode_ERR_INVALID_SERVICE_ID,
+			ErrMsg:  "unknown service id " + id,
+		}
+	}
+	if subtle.ConstantTimeCompare([]byte(key), []byte(expected)) != 1 {
+		return &config_backend.BaseResponse{
+			ErrCode: config_backend.ErrorCode_ERR_INVALID_SERVICE_KEY,
+			ErrMsg:  "invalid service key of " + id,
+		}
+	}
+
+	return nil
+}
+
+func success() *config_backend.BaseResponse {
+	return &config_backend.BaseResponse{
+		ErrCode: config_backend.ErrorCode_SUCCESS,
+	}
+}
+
+func internalError(method string, err error) *config_backend.BaseResponse {
+	logrus.Errorf("[configcenter.%s] %v", method, err)
+
+	return &config_backend.BaseResponse{
+		ErrCode: config_backend.ErrorCode_ERR_INTERNAL_SERVER_ERROR,
+		ErrMsg:  err.Error(),
+	}
+}
+
+func (s *Service) GetConfig(_ context.Context, req *config_backend.GetConfigRequest) (*config_backend.GetConfigResponse, error) {
+	if base := s.authenticate(req.ServiceId, req.ServiceKey); base != nil {
+		return &config_backend.GetConfigResponse{BaseResponse: base}, nil
+	}
+	value, ok, err := s.store.Get(req.ServiceId, req.Key)
+	if err != nil {
+		return &config_backend.GetConfigResponse{BaseResponse: internalError("GetConfig", err)}, nil
+	}
+
+	return &config_backend.GetConfigResponse{
+		BaseResponse: success(),
+		KeyExist:     ok,
+		Value:        value,
+	}, nil
+}
+
+func (s *Service) PutConfig(_ context.Context, req *config_backend.PutConfigRequest) (*config_backend.PutConfigResponse, error) {
+	if base := s.authenticate(req.ServiceId, req.ServiceKey); base != nil {
+		return &config_backend.PutConfigResponse{BaseResponse: base}, nil
+	}
+	if err := s.store.Put(req.ServiceId, req.Key, req.Value); err != nil {
+		return &config_backend.PutConfigResponse{BaseResponse: internalError("PutConfig", err)}, nil
+	}
+
+	return &config_backend.PutConfigResponse{BaseResponse: success()}, nil
+}
+
+func (s *Service) GetAllKeys(_ context.Context, req *config_backend.GetAllKeysRequest) (*config_backend.GetAllKeysResponse, error) {
+	if base := s.authenticate(req.ServiceId, req.ServiceKey); base != nil {
+		return &config_backend.GetAllKeysResponse{BaseResponse: base}, nil
+	}
+	keys, err := s.store.Keys(req.ServiceId)
+	if err != nil {
+		return &config_backend.GetAllKeysResponse{BaseResponse: internalError("GetAllKeys", err)}, nil
+	}
+
+	return &config_backend.GetAllKeysResponse{
+		BaseResponse: success(),
+		Keys:         keys,
+	}, nil
+}
@@ -0,0 +1,145 @@
+package configcenter
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Store holds the configuration values of every service
+type Store interface {
+	// Get returns the value of key of service, ok is false if it doesn't exist
+	Get(service, key string) (value string, ok bool, err error)
+	Put(service, key, value string) error
+	// Keys returns the keys of service in ascending order
+	Keys(service string) ([]string, error)
+}
+
+// memoryStore keeps the values in memory
+type memoryStore struct {
+	mux    sync.RWMutex
+	values map[string]map[string]string
+}
+
+// NewMemoryStore returns a Store which keeps the values in memory
+func NewMemoryStore() Store {
+	return &memoryStore{
+		values: make(map[string]map[string]string),
+	}
+}
+
+func (s *memoryStore) Get(service, key string) (string, bool, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	value, ok := s.values[service][key]
+
+	return value, ok, nil
+}
+
+func (s *memoryStore) Put(service, key, value string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.put(service, key, value)
+
+	return nil
+}
+
+func (s *memoryStore) put(service, key, value string) {
+	if s.values[service] == nil {
+		s.values[service] = make(map[string]string)
+	}
+	s.values[service][key] = value
+}
+
+func (s *memoryStore) Keys(service string) ([]string, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	keys := make([]string, 0, len(s.values[service]))
+	for key := range s.values[service] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys, nil
+}
+
+// fileStore keeps the values in memory and writes them to a JSON file on every Put
+type fileStore struct {
+	*memoryStore
+	path string
+}
+
+// NewFileStore returns a Store persisted to the JSON file at path, the file is created by the first Put if it
+// doesn't exist. The file is replaced atomically, so it's never left half written
+func NewFileStore(path string) (Store, error) {
+	s := &fileStore{
+		memoryStore: NewMemoryStore().(*memoryStore),
+		path:        path,
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(b, &s.values); err != nil {
+		return nil, err
+	}
+	if s.values == nil {
+		s.values = make(map[string]map[string]string)
+	}
+
+	return s, nil
+}
+
+func (s *fileStore) Put(service, key, value string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	previous, existed := s.values[service][key]
+	s.put(service, key, value)
+	if err := s.save(); err != nil {
+		// the memory follows the file
+		if existed {
+			s.values[service][key] = previous
+		} else {
+			delete(s.values[service], key)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// save writes the values to a temporary file renamed to path
+func (s *fileStore) save() error {
+	b, err := json.MarshalIndent(s.values, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path)
+}
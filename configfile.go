@@ -0,0 +1,416 @@
+package scrpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultConfigFile is the configuration file of the service in its working directory
+const DefaultConfigFile = ".scrpc.yml"
+
+// DefaultWatchInterval is the default interval at which a watched configuration file is checked for changes
+const DefaultWatchInterval = 5 * time.Second
+
+// Duration is a time.Duration written as a string like "1.5s" in configuration files
+type Duration time.Duration
+
+func (d *Duration) parse(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+
+	return nil
+}
+
+// duration returns d as a *time.Duration, nil if d is omitted
+func (d *Duration) duration() *time.Duration {
+	if d == nil {
+		return nil
+	}
+
+	return Timeout(time.Duration(*d))
+}
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+
+	return d.parse(s)
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	return d.parse(s)
+}
+
+// FileConfig is the schema of the configuration file, in YAML or in JSON if its name ends with .json.
+// Omitted values are filled by DefaultConfig like the unset fields of a Config
+type FileConfig struct {
+	// Service and ServiceKey identify the service to the config backend
+	Service    string `yaml:"service" json:"service"`
+	ServiceKey string `yaml:"serviceKey" json:"serviceKey"`
+
+	Transport struct {
+		Local  *FileTransportConfig `yaml:"local" json:"local"`
+		Remote *FileTransportConfig `yaml:"remote" json:"remote"`
+	} `yaml:"transport" json:"transport"`
+	Timeouts *struct {
+		Dial      *Duration `yaml:"dial" json:"dial"`
+		Handshake *Duration `yaml:"handshake" json:"handshake"`
+		Request   *Duration `yaml:"request" json:"request"`
+	} `yaml:"timeouts" json:"timeouts"`
+	Limits *struct {
+		MaxHeaderSize uint64 `yaml:"maxHeaderSize" json:"maxHeaderSize"`
+		MaxBodySize   uint64 `yaml:"maxBodySize" json:"maxBodySize"`
+		MaxInFlight   int    `yaml:"maxInFlight" json:"maxInFlight"`
+	} `yaml:"limits" json:"limits"`
+	Mode     string                        `yaml:"mode" json:"mode"`
+	Peers    map[string]string             `yaml:"peers" json:"peers"`
+	Services map[string]*FileServicePolicy `yaml:"services" json:"services"`
+}
+
+type FileTransportConfig struct {
+	Protocol string `yaml:"protocol" json:"protocol"`
+	Path     string `yaml:"path" json:"path"`
+	Pool     *struct {
+		InitSize int `yaml:"initSize" json:"initSize"`
+		MaxSize  int `yaml:"maxSize" json:"maxSize"`
+	} `yaml:"pool" json:"pool"`
+	Handshake *bool `yaml:"handshake" json:"handshake"`
+	Checksum  *bool `yaml:"checksum" json:"checksum"`
+}
+
+type FileServicePolicy struct {
+	Timeout Duration `yaml:"timeout" json:"timeout"`
+	Retry   *struct {
+		MaxAttempts int      `yaml:"maxAttempts" json:"maxAttempts"`
+		Backoff     Duration `yaml:"backoff" json:"backoff"`
+		MaxBackoff  Duration `yaml:"maxBackoff" json:"maxBackoff"`
+	} `yaml:"retry" json:"retry"`
+}
+
+// ReadConfigFile parses the configuration file at path
+func ReadConfigFile(path string) (*FileConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseConfigFile(path, b)
+}
+
+func parseConfigFile(path string, b []byte) (*FileConfig, error) {
+	fileCfg := &FileConfig{}
+	var err error
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		decoder := json.NewDecoder(bytes.NewReader(b))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(fileCfg)
+	} else {
+		err = yaml.UnmarshalStrict(b, fileCfg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: parse %s failed: %v", ErrInvalidConfig, path, err)
+	}
+
+	return fileCfg, nil
+}
+
+// LoadConfigFile reads the configuration file at path and returns it as a Config
+func LoadConfigFile(path string) (*Config, error) {
+	fileCfg, err := ReadConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return fileCfg.Config(), nil
+}
+
+// Config converts the file to a Config, the omitted values are left zero
+func (f *FileConfig) Config() *Config {
+	c := &Config{
+		LocalTransportConfig:  f.Transport.Local.config(),
+		RemoteTransportConfig: f.Transport.Remote.config(),
+		Mode:                  TransportMode(f.Mode),
+		Peers:                 f.Peers,
+	}
+	if f.Timeouts != nil {
+		c.Timeouts = &TimeoutConfig{
+			Dial:      f.Timeouts.Dial.duration(),
+			Handshake: f.Timeouts.Handshake.duration(),
+			Request:   f.Timeouts.Request.duration(),
+		}
+	}
+	if f.Limits != nil {
+		c.Limits = &LimitConfig{
+			MaxHeaderSize: f.Limits.MaxHeaderSize,
+			MaxBodySize:   f.Limits.MaxBodySize,
+			MaxInFlight:   f.Limits.MaxInFlight,
+		}
+	}
+	if f.Services != nil {
+		c.Services = make(map[string]*ServicePolicy, len(f.Services))
+		for service, policy := range f.Services {
+			if policy != nil {
+				c.Services[service] = policy.config()
+			}
+		}
+	}
+
+	return c
+}
+
+func (t *FileTransportConfig) config() *TransportConfig {
+	if t == nil {
+		return nil
+	}
+	c := &TransportConfig{
+		Protocol:  t.Protocol,
+		Path:      t.Path,
+		Handshake: t.Handshake,
+		Checksum:  t.Checksum,
+	}
+	if t.Pool != nil {
+		c.PoolCfg = &PoolConfig{
+			InitSize: t.Pool.InitSize,
+			MaxSize:  t.Pool.MaxSize,
+		}
+	}
+
+	return c
+}
+
+func (p *FileServicePolicy) config() *ServicePolicy {
+	c := &ServicePolicy{
+		Timeout: time.Duration(p.Timeout),
+	}
+	if p.Retry != nil {
+		c.Retry = &RetryPolicy{
+			MaxAttempts: p.Retry.MaxAttempts,
+			Backoff:     time.Duration(p.Retry.Backoff),
+			MaxBackoff:  time.Duration(p.Retry.MaxBackoff),
+		}
+	}
+
+	return c
+}
+
+// ConfigWatcher polls a configuration file and reports its new content whenever it changes
+type ConfigWatcher struct {
+	path     string
+	interval time.Duration
+	onChange func(cfg *Config)
+	last     []byte
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// WatchConfigFile calls onChange with the new configuration every time the file at path changes, the file is
+// checked every interval, DefaultWatchInterval if it's not positive. A file which can't be read or parsed
+// is logged and skipped, so onChange only sees valid files
+func WatchConfigFile(path string, interval time.Duration, onChange func(cfg *Config)) (*ConfigWatcher, error) {
+	last, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return watchConfigFile(path, interval, last, onChange), nil
+}
+
+// watchConfigFile acts like WatchConfigFile, last is the content of the file already known, nil if it's unknown
+func watchConfigFile(path string, interval time.Duration, last []byte, onChange func(cfg *Config)) *ConfigWatcher {
+	if interval <= 0 {
+		interval = DefaultWatchInterval
+	}
+	w := &ConfigWatcher{
+		path:     path,
+		interval: interval,
+		onChange: onChange,
+		last:     last,
+		stop:     make(chan struct{}),
+	}
+	go w.run()
+
+	return w
+}
+
+func (w *ConfigWatcher) run() {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			w.check()
+		}
+	}
+}
+
+func (w *ConfigWatcher) check() {
+	b, err := os.ReadFile(w.path)
+	if err != nil {
+		logrus.Warnf("[ConfigWatcher] read %s failed: %v", w.path, err)
+		return
+	}
+	if bytes.Equal(b, w.last) {
+		return
+	}
+	w.last = b
+	fileCfg, err := parseConfigFile(w.path, b)
+	if err != nil {
+		logrus.Errorf("[ConfigWatcher] %v", err)
+		return
+	}
+	logrus.Infof("[ConfigWatcher] %s changed, reloading", w.path)
+	w.onChange(fileCfg.Config())
+}
+
+// Close stops watching the file
+func (w *ConfigWatcher) Close() {
+	w.stopOnce.Do(func() {
+		close(w.stop)
+	})
+}
+
+// liveConfig is the resolved configuration of a client or a server, it's replaced whenever its file changes
+type liveConfig struct {
+	// explicit is set by WithConfig or WithServerConfig, file by WithConfigFile or WithServerConfigFile
+	explicit *Config
+	file     string
+	// current holds the configState in use, mux serializes its updates
+	current atomic.Value
+	mux     sync.Mutex
+	closed  bool
+	watcher *ConfigWatcher
+}
+
+// configState is the resolved configuration, or the reason it's invalid along with the built-in configuration
+// used meanwhile
+type configState struct {
+	cfg *Config
+	err error
+}
+
+func (l *liveConfig) state() configState {
+	state, _ := l.current.Load().(configState)
+
+	return state
+}
+
+// config returns the current configuration
+func (l *liveConfig) config() *Config {
+	return l.state().cfg
+}
+
+// err returns the reason the current configuration is invalid, ErrClosed once closed
+func (l *liveConfig) err() error {
+	return l.state().err
+}
+
+// resolve resolves the initial configuration, the built-in configuration is used if it's invalid
+func (l *liveConfig) resolve() error {
+	explicit := l.explicit
+	var err error
+	if l.file != "" {
+		explicit, err = LoadConfigFile(l.file)
+	}
+	var resolved *Config
+	if err == nil {
+		resolved, err = ResolveConfig(explicit)
+	}
+	if err != nil {
+		l.current.Store(configState{cfg: builtinConfig(), err: err})
+		return err
+	}
+	l.current.Store(configState{cfg: resolved})
+
+	return nil
+}
+
+// watch starts watching the file of the configuration if there's one. It's watched even if it's invalid, so that
+// fixing it recovers the client or the server. onReload is called after every successful reload with the previous
+// configuration, nil if it was invalid
+func (l *liveConfig) watch(onReload func(old, cfg *Config)) {
+	if l.file == "" {
+		return
+	}
+	// a missing or invalid file was reported by resolve, only its changes matter
+	last, _ := os.ReadFile(l.file)
+	l.watcher = watchConfigFile(l.file, 0, last, func(fileCfg *Config) {
+		reloaded, err := ResolveConfig(fileCfg)
+		if err != nil {
+			logrus.Errorf("[liveConfig] %s is ignored, the current configuration is kept: %v", l.file, err)
+			return
+		}
+		l.mux.Lock()
+		if l.closed {
+			l.mux.Unlock()
+			return
+		}
+		var old *Config
+		if current := l.state(); current.err == nil {
+			old = current.cfg
+			if err = checkReload(old, reloaded); err != nil {
+				l.mux.Unlock()
+				logrus.Errorf("[liveConfig] %s is ignored, the current configuration is kept: %v", l.file, err)
+				return
+			}
+		}
+		l.current.Store(configState{cfg: reloaded})
+		l.mux.Unlock()
+		onReload(old, reloaded)
+	})
+}
+
+// checkReload rejects the changes a running client or server can't apply, the transport mode and the paths are
+// bound to its connection pools and to its listener
+func checkReload(old, reloaded *Config) error {
+	var changes []string
+	if old.Mode != reloaded.Mode {
+		changes = append(changes, fmt.Sprintf("Mode %q to %q", old.Mode, reloaded.Mode))
+	}
+	if from, to := old.LocalTransportConfig.Path, reloaded.LocalTransportConfig.Path; from != to {
+		changes = append(changes, fmt.Sprintf("LocalTransportConfig.Path %q to %q", from, to))
+	}
+	if from, to := old.RemoteTransportConfig.Path, reloaded.RemoteTransportConfig.Path; from != to {
+		changes = append(changes, fmt.Sprintf("RemoteTransportConfig.Path %q to %q", from, to))
+	}
+	if len(changes) > 0 {
+		return fmt.Errorf("%w: changing %s requires a restart", ErrInvalidConfig, strings.Join(changes, ", "))
+	}
+
+	return nil
+}
+
+// close stops watching the file, the subsequent calls to err return ErrClosed
+func (l *liveConfig) close() {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if l.closed {
+		return
+	}
+	l.closed = true
+	if l.watcher != nil {
+		l.watcher.Close()
+	}
+	l.current.Store(configState{cfg: l.config(), err: ErrClosed})
+}
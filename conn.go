@@ -1,7 +1,12 @@
 package scrpc
 
 import (
+	"bufio"
+	"fmt"
+	"github.com/sirupsen/logrus"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -10,6 +15,9 @@ const (
 	ConnTypeSideCar2SideCar = "side_car_to_side_car"
 )
 
+// connReadBufferSize is the size of the read buffer of a connection, small messages are read by a single syscall
+const connReadBufferSize = 32 << 10
+
 type ConnOpt func(conn *Conn)
 
 func WithType(connType string) ConnOpt {
@@ -18,30 +26,149 @@ func WithType(connType string) ConnOpt {
 	}
 }
 
-// Conn is a wrapper to net.Conn
-type Conn struct {
-	NetConn net.Conn
-	Type    string
+// WithReadOpts sets the limits of the messages read from the connection by ReadMessage and FromReader
+func WithReadOpts(opts ...ReadOpt) ConnOpt {
+	return func(conn *Conn) {
+		conn.readOpts = append(conn.readOpts, opts...)
+	}
 }
 
-func Dial(network, address string, opts ...ConnOpt) (*Conn, error) {
-	netConn, err := net.Dial(network, address)
-	if err != nil {
-		return nil, err
+// WithHandshake enables or disables the handshake of the connection, it's disabled by default so that dialing
+// peers predating the handshake keeps working. Accepted connections take the setting of their Listener
+func WithHandshake(enabled bool) ConnOpt {
+	return func(conn *Conn) {
+		conn.handshakeEnabled = enabled
 	}
+}
+
+// WithHandshakeTimeout bounds the handshake of the connection, 5 seconds by default and no bound if d is zero
+func WithHandshakeTimeout(d time.Duration) ConnOpt {
+	return func(conn *Conn) {
+		conn.handshakeTimeout = d
+	}
+}
+
+// WithFeatures sets the features advertised by the handshake, SupportedFeatures by default
+func WithFeatures(features Feature) ConnOpt {
+	return func(conn *Conn) {
+		conn.features = features
+	}
+}
 
+// WithChecksum appends a CRC32C trailer to every frame written if the peer supports FeatureChecksum
+func WithChecksum(enabled bool) ConnOpt {
+	return func(conn *Conn) {
+		conn.checksum = enabled
+	}
+}
+
+// Conn is a wrapper to net.Conn, reads are buffered
+type Conn struct {
+	NetConn  net.Conn
+	Type     string
+	reader   *bufio.Reader
+	readOpts []ReadOpt
+
+	handshakeEnabled bool
+	handshakeTimeout time.Duration
+	features         Feature
+	protocol         Protocol
+	checksum         bool
+
+	// writeMux serializes the frames written
+	writeMux sync.Mutex
+	broken   int32
+}
+
+// NewConn wraps netConn, the handshake is left to the caller
+func NewConn(netConn net.Conn, opts ...ConnOpt) *Conn {
 	conn := &Conn{
-		NetConn: netConn,
+		NetConn:          netConn,
+		reader:           bufio.NewReaderSize(netConn, connReadBufferSize),
+		handshakeTimeout: handshakeTimeout,
+		features:         SupportedFeatures,
 	}
 	for _, opt := range opts {
 		opt(conn)
 	}
 
+	return conn
+}
+
+func Dial(network, address string, opts ...ConnOpt) (*Conn, error) {
+	return DialTimeout(network, address, 0, opts...)
+}
+
+// DialTimeout acts like Dial but bounds the establishment of the connection by timeout, zero means no bound
+func DialTimeout(network, address string, timeout time.Duration, opts ...ConnOpt) (*Conn, error) {
+	netConn, err := net.DialTimeout(network, address, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := NewConn(netConn, opts...)
+	if conn.handshakeEnabled {
+		if err = conn.handshake(true); err != nil {
+			if closeErr := conn.Close(); closeErr != nil {
+				logrus.Warnf("[Dial] close connection failed: %v", closeErr)
+			}
+			return nil, fmt.Errorf("handshake with %s failed: %w", address, err)
+		}
+	}
+
 	return conn, nil
 }
 
+// writeBuffers writes buffers under the write lock, the connection is marked broken after a partial write
+func (c *Conn) writeBuffers(buffers net.Buffers) (int, error) {
+	size := 0
+	for _, b := range buffers {
+		size += len(b)
+	}
+
+	c.writeMux.Lock()
+	// net.Buffers only issues writev on the connections of package net
+	n, err := buffers.WriteTo(c.NetConn)
+	c.writeMux.Unlock()
+	if err != nil && n > 0 && int(n) < size {
+		c.MarkBroken()
+	}
+
+	return int(n), err
+}
+
+// MarkBroken marks the connection as out of sync with its peer, the Manager closes it instead of reusing it
+func (c *Conn) MarkBroken() {
+	atomic.StoreInt32(&c.broken, 1)
+}
+
+// Broken reports whether the connection is marked broken
+func (c *Conn) Broken() bool {
+	return atomic.LoadInt32(&c.broken) == 1
+}
+
+func (c *Conn) checksumEnabled() bool {
+	return c.checksum && c.protocol.Features.Has(FeatureChecksum)
+}
+
+// Supports reports whether the peer of the connection supports all of features. The features of a peer which
+// skipped the handshake are unknown, they are assumed to be supported as before the handshake existed, except
+// FeatureChecksum which is only used once negotiated
+func (c *Conn) Supports(features Feature) bool {
+	if c.protocol.Version == 0 {
+		return !features.Has(FeatureChecksum)
+	}
+
+	return c.protocol.Features.Has(features)
+}
+
 func (c *Conn) Read(b []byte) (n int, err error) {
-	return c.NetConn.Read(b)
+	if c.reader == nil {
+		// the Conn was built without NewConn
+		return c.NetConn.Read(b)
+	}
+
+	return c.reader.Read(b)
 }
 
 func (c *Conn) Write(b []byte) (n int, err error) {
@@ -80,9 +207,26 @@ func WithListenerType(lisType string) LisOpt {
 	}
 }
 
+// WithListenerHandshake enables or disables the handshake of accepted connections, it's enabled by default.
+// Dialers which don't start the handshake are served with the legacy framing either way
+func WithListenerHandshake(enabled bool) LisOpt {
+	return func(listener *Listener) {
+		listener.handshake = enabled
+	}
+}
+
+// WithListenerConnOpts applies opts to the accepted connections after the type and the handshake of the listener
+func WithListenerConnOpts(opts ...ConnOpt) LisOpt {
+	return func(listener *Listener) {
+		listener.connOpts = append(listener.connOpts, opts...)
+	}
+}
+
 type Listener struct {
-	Listener net.Listener
-	Type     string
+	Listener  net.Listener
+	Type      string
+	handshake bool
+	connOpts  []ConnOpt
 }
 
 func Listen(protocol, addr string, opts ...LisOpt) (*Listener, error) {
@@ -91,7 +235,8 @@ func Listen(protocol, addr string, opts ...LisOpt) (*Listener, error) {
 		return nil, err
 	}
 	listener := &Listener{
-		Listener: netListener,
+		Listener:  netListener,
+		handshake: true,
 	}
 	for _, opt := range opts {
 		opt(listener)
@@ -100,16 +245,16 @@ func Listen(protocol, addr string, opts ...LisOpt) (*Listener, error) {
 	return listener, nil
 }
 
+// Accept waits for the next connection, Conn.AcceptHandshake must be called before using it
 func (l *Listener) Accept() (*Conn, error) {
 	netConn, err := l.Listener.Accept()
 	if err != nil {
 		return nil, err
 	}
 
-	return &Conn{
-		NetConn: netConn,
-		Type:    l.Type,
-	}, nil
+	opts := append([]ConnOpt{WithType(l.Type), WithHandshake(l.handshake)}, l.connOpts...)
+
+	return NewConn(netConn, opts...), nil
 }
 
 func (l *Listener) Close() error {
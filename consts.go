@@ -3,5 +3,54 @@ package scrpc
 import "errors"
 
 var (
-	ErrThrottled = errors.New("request is throttled")
+	ErrThrottled      = errors.New("request is throttled")
+	ErrNotInHandler   = errors.New("context is not a server handler context")
+	ErrRemote         = errors.New("remote handler failed")
+	ErrStreamClosed   = errors.New("stream is closed")
+	ErrStreamProtocol = errors.New("stream protocol violation")
+	// ErrUnknownCompressor is returned if a compressor is not registered in package compress
+	ErrUnknownCompressor = errors.New("unknown compressor")
+	// ErrUnknownCodec is returned if a codec is not registered in package codec
+	ErrUnknownCodec = errors.New("unknown codec")
+	// ErrCodecNotSupported is returned if a method can't decode requests of a registered codec
+	ErrCodecNotSupported = errors.New("codec not supported")
+	// ErrMessageTooLarge is returned if the header or the body of a message read exceeds its limit
+	ErrMessageTooLarge = errors.New("message too large")
+	// ErrProtocolMismatch is returned by the handshake if the peer doesn't speak a compatible wire protocol
+	ErrProtocolMismatch = errors.New("protocol mismatch")
+	// ErrUnsupportedFeature is returned if a message relies on a feature the peer didn't advertise by the handshake
+	ErrUnsupportedFeature = errors.New("feature not supported by the peer")
+	// ErrCorruptFrame is returned if the checksum of a frame doesn't match, the connection is closed
+	ErrCorruptFrame = errors.New("corrupt frame")
+	// ErrClosed is returned by the requests of a closed Client and by Start once the Server is closed
+	ErrClosed = errors.New("closed")
+	// ErrUnknownPeer is returned in TransportRemote mode if the side-car of the receiver service is not in Config.Peers
+	ErrUnknownPeer = errors.New("unknown peer")
 )
+
+// StatusCode classifies the result of a request, it is mainly used for logging and instrumentation
+type StatusCode string
+
+const (
+	StatusOK        StatusCode = "OK"
+	StatusThrottled StatusCode = "THROTTLED"
+	StatusRemote    StatusCode = "REMOTE_ERROR"
+	StatusTooLarge  StatusCode = "MESSAGE_TOO_LARGE"
+	StatusUnknown   StatusCode = "UNKNOWN"
+)
+
+// StatusCodeOf returns the StatusCode of the result err
+func StatusCodeOf(err error) StatusCode {
+	switch {
+	case err == nil:
+		return StatusOK
+	case errors.Is(err, ErrThrottled):
+		return StatusThrottled
+	case errors.Is(err, ErrRemote):
+		return StatusRemote
+	case errors.Is(err, ErrMessageTooLarge):
+		return StatusTooLarge
+	default:
+		return StatusUnknown
+	}
+}
@@ -0,0 +1,128 @@
+package scrpc
+
+import (
+	"context"
+	"fmt"
+	"github.com/victor-leee/scrpc/codec"
+	"github.com/victor-leee/scrpc/github.com/victor-leee/scrpc"
+	"google.golang.org/protobuf/proto"
+)
+
+// encoding describes how the bodies of a call are written, serialized by a codec and then compressed
+type encoding struct {
+	codec codec.Codec
+	comp  compression
+}
+
+func newEncoding(codecName string, comp compression) (encoding, error) {
+	c := codec.Get(codecName)
+	if c == nil {
+		return encoding{}, fmt.Errorf("%w: %s", ErrUnknownCodec, codecName)
+	}
+
+	return encoding{
+		codec: c,
+		comp:  comp,
+	}, nil
+}
+
+// responseEncoding is the encoding of the answers to a request with header read from conn, it follows the codec
+// and the compressor of the caller
+func responseEncoding(conn *Conn, header *scrpc.Header, threshold int) encoding {
+	c := codec.Get(header.Codec)
+	if c == nil {
+		// the request can't be decoded either, answer with the default codec
+		c = codec.Get(codec.Proto)
+	}
+
+	return encoding{
+		codec: c,
+		comp:  responseCompression(header, threshold),
+	}.forConn(conn)
+}
+
+// forConn leaves compression out if the peer of conn doesn't support it
+func (e encoding) forConn(conn *Conn) encoding {
+	if !conn.Supports(FeatureCompression) {
+		e.comp = compression{}
+	}
+
+	return e
+}
+
+// messageFor returns msg, the message of m built by message, or rebuilds it without compression if the peer of
+// conn doesn't support it. The header of msg is left untouched so that msg can be written to other connections
+func (e encoding) messageFor(conn *Conn, msg *Message, m proto.Message) (*Message, error) {
+	if msg.Header.Compression == "" || conn.Supports(FeatureCompression) {
+		return msg, nil
+	}
+	header := proto.Clone(msg.Header).(*scrpc.Header)
+	header.Compression = ""
+	header.Compressed = false
+
+	return e.forConn(conn).message(m, header)
+}
+
+// marshal serializes and compresses m, the codec and the compressor are recorded in header
+func (e encoding) marshal(m proto.Message, header *scrpc.Header) ([]byte, error) {
+	body, err := e.codec.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+
+	return e.apply(body, header)
+}
+
+// apply compresses body already serialized by the codec, the codec and the compressor are recorded in header
+func (e encoding) apply(body []byte, header *scrpc.Header) ([]byte, error) {
+	if e.codec.Name() != codec.Proto {
+		header.Codec = e.codec.Name()
+	}
+
+	return e.comp.apply(body, header)
+}
+
+// message builds a Message of m like FromProtoMessage does, with the codec and the compressor applied
+func (e encoding) message(m proto.Message, header *scrpc.Header) (*Message, error) {
+	if header == nil {
+		header = &scrpc.Header{}
+	}
+	body, err := e.marshal(m, header)
+	if err != nil {
+		return nil, err
+	}
+
+	return FromBody(body, header), nil
+}
+
+// unmarshalBody deserializes a body already decompressed by FromReader with the codec named by its header
+func unmarshalBody(header *scrpc.Header, b []byte, m proto.Message) error {
+	c := codec.Get(header.Codec)
+	if c == nil {
+		return fmt.Errorf("%w: %s", ErrUnknownCodec, header.Codec)
+	}
+
+	return c.Unmarshal(b, m)
+}
+
+type codecCtxKey struct{}
+
+func contextWithCodec(ctx context.Context, header *scrpc.Header) context.Context {
+	return context.WithValue(ctx, codecCtxKey{}, header.Codec)
+}
+
+// CodecFromContext returns the codec of the request being served, handlers receiving raw bodies use it to
+// decode the request, the protobuf codec is returned if ctx isn't a handler context
+func CodecFromContext(ctx context.Context) codec.Codec {
+	name, _ := ctx.Value(codecCtxKey{}).(string)
+	if c := codec.Get(name); c != nil {
+		return c
+	}
+
+	return codec.Get(codec.Proto)
+}
+
+// UnmarshalRequest decodes the request body b of the request being served into m with the codec of the caller
+func UnmarshalRequest(ctx context.Context, b []byte, m proto.Message) error {
+	return CodecFromContext(ctx).Unmarshal(b, m)
+}
@@ -0,0 +1,348 @@
+package etcd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	config_backend "github.com/victor-leee/scrpc/github.com/victor-leee/config-backend"
+	"gopkg.in/yaml.v2"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultCacheTTL is the default time a value is served from the cache without asking the config backend
+	DefaultCacheTTL = 30 * time.Second
+	// DefaultStaleTTL is the default time an expired value is still served while it's fetched in the background
+	DefaultStaleTTL = 5 * time.Minute
+	// refreshTimeout bounds the background fetches of expired values
+	refreshTimeout = 10 * time.Second
+	// failureBackoff is the wait before a key the config backend failed to serve is fetched again,
+	// its last known value is served meanwhile
+	failureBackoff = 5 * time.Second
+)
+
+// Cache serves the values of a ServiceConfig from memory. A value is fresh for the TTL, then it's stale for
+// the stale TTL: it's still served while a background fetch revalidates it. Older values are fetched before
+// being served, and if the config backend fails the last known value is served instead and the key is not fetched
+// again before a backoff. A key without known value fails alike until the backoff elapses.
+// The concurrent lookups of a key share a single fetch.
+// Cache implements ServiceConfig itself, and Watcher if its source does, watches are not cached
+type Cache struct {
+	src      ServiceConfig
+	ttl      time.Duration
+	staleTTL time.Duration
+
+	mux     sync.Mutex
+	entries map[string]*cacheEntry
+	fetches map[string]*fetchCall
+}
+
+var (
+	_ ServiceConfig = (*Cache)(nil)
+	_ Watcher       = (*Cache)(nil)
+)
+
+// cacheEntry is the last known value of a key, or the failure to fetch a key without known value if err is set
+type cacheEntry struct {
+	value      string
+	exists     bool
+	err        error
+	fetchedAt  time.Time
+	retryAt    time.Time
+	refreshing bool
+}
+
+// fetchCall is a fetch of a key shared by the lookups waiting for it, entry and err are set once done is closed
+type fetchCall struct {
+	done  chan struct{}
+	entry *cacheEntry
+	err   error
+}
+
+type CacheOpt func(c *Cache)
+
+// WithTTL sets how long a value is served without asking the config backend, DefaultCacheTTL by default
+func WithTTL(d time.Duration) CacheOpt {
+	return func(c *Cache) {
+		c.ttl = d
+	}
+}
+
+// WithStaleTTL sets how long an expired value is still served while it's fetched in the background,
+// DefaultStaleTTL by default, zero disables stale-while-revalidate
+func WithStaleTTL(d time.Duration) CacheOpt {
+	return func(c *Cache) {
+		c.staleTTL = d
+	}
+}
+
+func NewCache(src ServiceConfig, opts ...CacheOpt) *Cache {
+	c := &Cache{
+		src:      src,
+		ttl:      DefaultCacheTTL,
+		staleTTL: DefaultStaleTTL,
+		entries:  make(map[string]*cacheEntry),
+		fetches:  make(map[string]*fetchCall),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+var (
+	cachedConfig     *Cache
+	cachedConfigOnce sync.Once
+)
+
+// GetCachedConfigClient returns the cache of GetConfigClient with the default options
+func GetCachedConfigClient() *Cache {
+	cachedConfigOnce.Do(func() {
+		cachedConfig = NewCache(serviceConfig)
+	})
+
+	return cachedConfig
+}
+
+// fetch asks the config backend for the value of key
+func (c *Cache) fetch(ctx context.Context, key string) (*cacheEntry, error) {
+	if c.src == nil {
+		return nil, errEmptyConfig
+	}
+	resp, err := c.src.Get(ctx, key)
+	if err = checkResponse(resp.GetBaseResponse(), err); err != nil {
+		return nil, err
+	}
+
+	return &cacheEntry{
+		value:     resp.Value,
+		exists:    resp.KeyExist,
+		fetchedAt: time.Now(),
+	}, nil
+}
+
+// lookup returns the value of key, exists is false if the key doesn't exist
+func (c *Cache) lookup(ctx context.Context, key string) (value string, exists bool, err error) {
+	c.mux.Lock()
+	entry := c.entries[key]
+	if entry != nil {
+		now := time.Now()
+		if now.Before(entry.retryAt) {
+			c.mux.Unlock()
+			return entry.value, entry.exists, entry.err
+		}
+		if entry.err != nil {
+			// the backoff of a failed key elapsed, there's no value to serve meanwhile
+			entry = nil
+		}
+	}
+	if entry != nil {
+		age := time.Since(entry.fetchedAt)
+		if age < c.ttl {
+			c.mux.Unlock()
+			return entry.value, entry.exists, nil
+		}
+		if age < c.ttl+c.staleTTL {
+			if !entry.refreshing {
+				entry.refreshing = true
+				go c.refresh(key, entry)
+			}
+			c.mux.Unlock()
+			return entry.value, entry.exists, nil
+		}
+	}
+	call := c.fetches[key]
+	if call == nil {
+		call = &fetchCall{
+			done: make(chan struct{}),
+		}
+		c.fetches[key] = call
+		c.mux.Unlock()
+		c.fetchShared(ctx, key, call)
+	} else {
+		c.mux.Unlock()
+	}
+
+	select {
+	case <-call.done:
+	case <-ctx.Done():
+		return "", false, ctx.Err()
+	}
+	if call.err != nil {
+		if entry != nil {
+			return entry.value, entry.exists, nil
+		}
+		return "", false, call.err
+	}
+
+	return call.entry.value, call.entry.exists, nil
+}
+
+// fetchShared fetches key for the lookups waiting for call. After a failure the last known value is kept
+// and served until failureBackoff elapses, a key without known value fails until then.
+// The result is dropped if the key was invalidated meanwhile
+func (c *Cache) fetchShared(ctx context.Context, key string, call *fetchCall) {
+	call.entry, call.err = c.fetch(ctx, key)
+
+	c.mux.Lock()
+	defer func() {
+		c.mux.Unlock()
+		close(call.done)
+	}()
+	if c.fetches[key] != call {
+		return
+	}
+	delete(c.fetches, key)
+	if call.err == nil {
+		c.entries[key] = call.entry
+		return
+	}
+	if ctx.Err() != nil {
+		// the fetch was given up by the caller, the config backend didn't fail
+		return
+	}
+	if entry := c.entries[key]; entry != nil && entry.err == nil {
+		logrus.Warnf("[Cache] get %s failed, the last known value is served: %v", key, call.err)
+		entry.retryAt = time.Now().Add(failureBackoff)
+		return
+	}
+	logrus.Warnf("[Cache] get %s failed, it's not fetched again for %v: %v", key, failureBackoff, call.err)
+	c.entries[key] = &cacheEntry{
+		err:     call.err,
+		retryAt: time.Now().Add(failureBackoff),
+	}
+}
+
+// refresh fetches key whose value is entry in the background, the value is kept if it fails.
+// The result is dropped if entry was invalidated or replaced meanwhile
+func (c *Cache) refresh(key string, entry *cacheEntry) {
+	ctx, cancel := context.WithTimeout(context.Background(), refreshTimeout)
+	defer cancel()
+
+	fetched, err := c.fetch(ctx, key)
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	entry.refreshing = false
+	if c.entries[key] != entry {
+		return
+	}
+	if err != nil {
+		logrus.Warnf("[Cache] refresh %s failed, the last known value is kept: %v", key, err)
+		entry.retryAt = time.Now().Add(failureBackoff)
+		return
+	}
+	c.entries[key] = fetched
+}
+
+// Invalidate drops the cached value of key, the next lookup fetches it. The fetches of key in flight
+// don't store their result
+func (c *Cache) Invalidate(key string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	delete(c.entries, key)
+	delete(c.fetches, key)
+}
+
+func (c *Cache) Get(ctx context.Context, key string) (*config_backend.GetConfigResponse, error) {
+	value, exists, err := c.lookup(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &config_backend.GetConfigResponse{
+		BaseResponse: &config_backend.BaseResponse{
+			ErrCode: config_backend.ErrorCode_SUCCESS,
+		},
+		KeyExist: exists,
+		Value:    value,
+	}, nil
+}
+
+// Watch watches key on the source of the cache, the channel is closed at once if the source isn't a Watcher
+func (c *Cache) Watch(ctx context.Context, key string, opts ...WatchOpt) <-chan ConfigEvent {
+	w, ok := c.src.(Watcher)
+	if !ok {
+		logrus.Errorf("[Cache] watch %s failed: the source of the cache is not a Watcher", key)
+		return closedEvents()
+	}
+
+	return w.Watch(ctx, key, opts...)
+}
+
+// WatchPrefix watches prefix on the source of the cache, the channel is closed at once if the source isn't a Watcher
+func (c *Cache) WatchPrefix(ctx context.Context, prefix string, opts ...WatchOpt) <-chan ConfigEvent {
+	w, ok := c.src.(Watcher)
+	if !ok {
+		logrus.Errorf("[Cache] watch prefix %s failed: the source of the cache is not a Watcher", prefix)
+		return closedEvents()
+	}
+
+	return w.WatchPrefix(ctx, prefix, opts...)
+}
+
+func closedEvents() <-chan ConfigEvent {
+	events := make(chan ConfigEvent)
+	close(events)
+
+	return events
+}
+
+// GetString returns the value of key, def if it doesn't exist
+func (c *Cache) GetString(ctx context.Context, key string, def string) (string, error) {
+	return getTyped(c, ctx, key, def, func(s string) (string, error) {
+		return s, nil
+	})
+}
+
+// GetInt returns the value of key parsed as an int, def if it doesn't exist or it's invalid
+func (c *Cache) GetInt(ctx context.Context, key string, def int) (int, error) {
+	return getTyped(c, ctx, key, def, strconv.Atoi)
+}
+
+// GetBool returns the value of key parsed by strconv.ParseBool, def if it doesn't exist or it's invalid
+func (c *Cache) GetBool(ctx context.Context, key string, def bool) (bool, error) {
+	return getTyped(c, ctx, key, def, strconv.ParseBool)
+}
+
+// GetDuration returns the value of key parsed by time.ParseDuration, def if it doesn't exist or it's invalid
+func (c *Cache) GetDuration(ctx context.Context, key string, def time.Duration) (time.Duration, error) {
+	return getTyped(c, ctx, key, def, time.ParseDuration)
+}
+
+// Unmarshal decodes the value of key into v, as JSON if it's valid JSON and as YAML otherwise.
+// v is left unchanged if the key doesn't exist, so it may hold the defaults
+func (c *Cache) Unmarshal(ctx context.Context, key string, v interface{}) error {
+	value, exists, err := c.lookup(ctx, key)
+	if err != nil || !exists {
+		return err
+	}
+	if json.Valid([]byte(value)) {
+		err = json.Unmarshal([]byte(value), v)
+	} else {
+		err = yaml.Unmarshal([]byte(value), v)
+	}
+	if err != nil {
+		return fmt.Errorf("unmarshal %s failed: %w", key, err)
+	}
+
+	return nil
+}
+
+// getTyped returns the value of key parsed by parse, def along with the error if the lookup or parse fails
+func getTyped[T any](c *Cache, ctx context.Context, key string, def T, parse func(s string) (T, error)) (T, error) {
+	value, exists, err := c.lookup(ctx, key)
+	if err != nil || !exists {
+		return def, err
+	}
+	parsed, err := parse(value)
+	if err != nil {
+		return def, fmt.Errorf("parse %s failed: %w", key, err)
+	}
+
+	return parsed, nil
+}
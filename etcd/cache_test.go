@@ -0,0 +1,323 @@
+package etcd
+
+import (
+	"context"
+	"errors"
+	config_backend "github.com/victor-leee/scrpc/github.com/victor-leee/config-backend"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeConfig is a ServiceConfig serving values from memory
+type fakeConfig struct {
+	mux    sync.Mutex
+	values map[string]string
+	err    error
+	// block holds every Get until it's closed if it's set
+	block chan struct{}
+	// calls counts the Gets, returned the ones which returned
+	calls    int
+	returned int
+}
+
+func newFakeConfig(values map[string]string) *fakeConfig {
+	return &fakeConfig{
+		values: values,
+	}
+}
+
+func (f *fakeConfig) Get(ctx context.Context, key string) (*config_backend.GetConfigResponse, error) {
+	f.mux.Lock()
+	f.calls++
+	block := f.block
+	f.mux.Unlock()
+	defer func() {
+		f.mux.Lock()
+		f.returned++
+		f.mux.Unlock()
+	}()
+	if block != nil {
+		select {
+		case <-block:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	value, exists := f.values[key]
+
+	return &config_backend.GetConfigResponse{
+		BaseResponse: &config_backend.BaseResponse{
+			ErrCode: config_backend.ErrorCode_SUCCESS,
+		},
+		KeyExist: exists,
+		Value:    value,
+	}, nil
+}
+
+func (f *fakeConfig) set(key, value string) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	f.values[key] = value
+}
+
+func (f *fakeConfig) fail(err error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	f.err = err
+}
+
+// hold makes the next Gets wait until the returned function is called
+func (f *fakeConfig) hold() func() {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	block := make(chan struct{})
+	f.block = block
+	return func() {
+		f.mux.Lock()
+		f.block = nil
+		f.mux.Unlock()
+		close(block)
+	}
+}
+
+func (f *fakeConfig) counts() (calls, returned int) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	return f.calls, f.returned
+}
+
+// waitReturned waits for n Gets to return
+func (f *fakeConfig) waitReturned(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, returned := f.counts(); returned >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d Gets didn't return", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func mustGetString(t *testing.T, c *Cache, key, expected string) {
+	t.Helper()
+	value, err := c.GetString(context.Background(), key, "")
+	if err != nil {
+		t.Fatalf("get %s failed: %v", key, err)
+	}
+	if value != expected {
+		t.Fatalf("got %s=%q, expected %q", key, value, expected)
+	}
+}
+
+func TestCacheFreshHitSkipsBackend(t *testing.T) {
+	src := newFakeConfig(map[string]string{"k": "v1"})
+	c := NewCache(src, WithTTL(time.Hour))
+
+	mustGetString(t, c, "k", "v1")
+	src.set("k", "v2")
+	mustGetString(t, c, "k", "v1")
+	if calls, _ := src.counts(); calls != 1 {
+		t.Errorf("got %d backend calls, expected 1", calls)
+	}
+}
+
+func TestCacheStaleReadRefreshesOnce(t *testing.T) {
+	src := newFakeConfig(map[string]string{"k": "v1"})
+	c := NewCache(src, WithTTL(10*time.Millisecond), WithStaleTTL(time.Hour))
+	mustGetString(t, c, "k", "v1")
+	time.Sleep(20 * time.Millisecond)
+
+	src.set("k", "v2")
+	release := src.hold()
+	for i := 0; i < 10; i++ {
+		// the stale value is served while the refresh is held
+		mustGetString(t, c, "k", "v1")
+	}
+	release()
+	// the refresh stores its value once it returned
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		value, err := c.GetString(context.Background(), "k", "")
+		if err != nil {
+			t.Fatalf("get k failed: %v", err)
+		}
+		if value == "v2" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %q, the refreshed value wasn't stored", value)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if calls, _ := src.counts(); calls != 2 {
+		t.Errorf("got %d backend calls, expected 2", calls)
+	}
+}
+
+func TestCacheSharesConcurrentMisses(t *testing.T) {
+	src := newFakeConfig(map[string]string{"k": "v1"})
+	c := NewCache(src, WithTTL(time.Hour))
+	release := src.hold()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if value, err := c.GetString(context.Background(), "k", ""); err != nil || value != "v1" {
+				t.Errorf("got %q, %v, expected v1", value, err)
+			}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	release()
+	wg.Wait()
+
+	if calls, _ := src.counts(); calls != 1 {
+		t.Errorf("got %d backend calls, expected 1", calls)
+	}
+}
+
+func TestCacheServesLastKnownValueOnFailure(t *testing.T) {
+	src := newFakeConfig(map[string]string{"k": "v1"})
+	c := NewCache(src, WithTTL(10*time.Millisecond), WithStaleTTL(0))
+	mustGetString(t, c, "k", "v1")
+	time.Sleep(20 * time.Millisecond)
+
+	src.fail(errors.New("backend down"))
+	start := time.Now()
+	mustGetString(t, c, "k", "v1")
+	mustGetString(t, c, "k", "v1")
+	if calls, _ := src.counts(); calls != 2 {
+		t.Fatalf("got %d backend calls, expected 2", calls)
+	}
+	c.mux.Lock()
+	entry := c.entries["k"]
+	if backoff := entry.retryAt.Sub(start); backoff < failureBackoff || backoff > failureBackoff+time.Second {
+		t.Errorf("got a backoff of %v, expected %v", backoff, failureBackoff)
+	}
+	// the backoff elapses
+	entry.retryAt = time.Now()
+	c.mux.Unlock()
+
+	mustGetString(t, c, "k", "v1")
+	if calls, _ := src.counts(); calls != 3 {
+		t.Errorf("got %d backend calls after the backoff, expected 3", calls)
+	}
+}
+
+func TestCacheBacksOffKeyWithoutValue(t *testing.T) {
+	src := newFakeConfig(map[string]string{"k": "v1"})
+	src.fail(errors.New("backend down"))
+	c := NewCache(src)
+
+	for i := 0; i < 3; i++ {
+		if _, err := c.GetString(context.Background(), "k", ""); err == nil {
+			t.Fatal("got no error while the backend is down")
+		}
+	}
+	if calls, _ := src.counts(); calls != 1 {
+		t.Fatalf("got %d backend calls, expected 1", calls)
+	}
+
+	src.fail(nil)
+	c.mux.Lock()
+	c.entries["k"].retryAt = time.Now()
+	c.mux.Unlock()
+	mustGetString(t, c, "k", "v1")
+}
+
+func TestCacheInvalidateDuringRefresh(t *testing.T) {
+	src := newFakeConfig(map[string]string{"k": "v1"})
+	c := NewCache(src, WithTTL(10*time.Millisecond), WithStaleTTL(time.Hour))
+	mustGetString(t, c, "k", "v1")
+	time.Sleep(20 * time.Millisecond)
+
+	release := src.hold()
+	mustGetString(t, c, "k", "v1")
+	c.Invalidate("k")
+	release()
+	src.waitReturned(t, 2)
+	// the refresh stores its value right after the backend returned
+	time.Sleep(10 * time.Millisecond)
+
+	c.mux.Lock()
+	entry := c.entries["k"]
+	c.mux.Unlock()
+	if entry != nil {
+		t.Fatal("the refresh stored its value after Invalidate")
+	}
+	src.set("k", "v2")
+	mustGetString(t, c, "k", "v2")
+}
+
+func TestCacheTypedGetters(t *testing.T) {
+	src := newFakeConfig(map[string]string{
+		"int":      "42",
+		"bool":     "true",
+		"duration": "3s",
+		"object":   "name: scrpc",
+		"bad":      "[not a value",
+	})
+	c := NewCache(src)
+	ctx := context.Background()
+
+	if v, err := c.GetInt(ctx, "int", 1); err != nil || v != 42 {
+		t.Errorf("GetInt got %d, %v, expected 42", v, err)
+	}
+	if v, err := c.GetInt(ctx, "missing", 1); err != nil || v != 1 {
+		t.Errorf("GetInt of a missing key got %d, %v, expected the default", v, err)
+	}
+	if v, err := c.GetInt(ctx, "bad", 1); err == nil || v != 1 {
+		t.Errorf("GetInt of a bad value got %d, %v, expected the default and an error", v, err)
+	}
+
+	if v, err := c.GetBool(ctx, "bool", false); err != nil || !v {
+		t.Errorf("GetBool got %t, %v, expected true", v, err)
+	}
+	if v, err := c.GetBool(ctx, "missing", true); err != nil || !v {
+		t.Errorf("GetBool of a missing key got %t, %v, expected the default", v, err)
+	}
+	if v, err := c.GetBool(ctx, "bad", true); err == nil || !v {
+		t.Errorf("GetBool of a bad value got %t, %v, expected the default and an error", v, err)
+	}
+
+	if v, err := c.GetDuration(ctx, "duration", time.Second); err != nil || v != 3*time.Second {
+		t.Errorf("GetDuration got %v, %v, expected 3s", v, err)
+	}
+	if v, err := c.GetDuration(ctx, "missing", time.Second); err != nil || v != time.Second {
+		t.Errorf("GetDuration of a missing key got %v, %v, expected the default", v, err)
+	}
+	if v, err := c.GetDuration(ctx, "bad", time.Second); err == nil || v != time.Second {
+		t.Errorf("GetDuration of a bad value got %v, %v, expected the default and an error", v, err)
+	}
+
+	type object struct {
+		Name string `json:"name" yaml:"name"`
+	}
+	v := object{Name: "default"}
+	if err := c.Unmarshal(ctx, "object", &v); err != nil || v.Name != "scrpc" {
+		t.Errorf("Unmarshal got %+v, %v, expected scrpc", v, err)
+	}
+	v = object{Name: "default"}
+	if err := c.Unmarshal(ctx, "missing", &v); err != nil || v.Name != "default" {
+		t.Errorf("Unmarshal of a missing key got %+v, %v, expected the default", v, err)
+	}
+	if err := c.Unmarshal(ctx, "bad", &v); err == nil {
+		t.Error("Unmarshal of a bad value got no error")
+	}
+}
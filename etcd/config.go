@@ -3,23 +3,41 @@ package etcd
 import (
 	"context"
 	"errors"
+	"github.com/sirupsen/logrus"
+	"github.com/victor-leee/scrpc"
 	config_backend "github.com/victor-leee/scrpc/github.com/victor-leee/config-backend"
-	"gopkg.in/yaml.v2"
 	"os"
 )
 
+// errEmptyConfig is returned if .scrpc.yml couldn't be read
+var errEmptyConfig = errors.New("empty rpcCfg or config service")
+
 type ServiceConfig interface {
 	Get(ctx context.Context, key string) (*config_backend.GetConfigResponse, error)
 }
 
+// Watcher reports the changes of the configuration by polling the config backend, it's implemented by the
+// ServiceConfig of GetConfigClient and by Cache
+type Watcher interface {
+	// Watch reports the changes of key until ctx is done, the channel is closed then.
+	// The first event carries the current value if the key exists. Every poll costs one request
+	Watch(ctx context.Context, key string, opts ...WatchOpt) <-chan ConfigEvent
+	// WatchPrefix reports the changes of the keys starting with prefix until ctx is done, the channel is closed then.
+	// The first events carry the current values of the existing keys. Every poll lists the keys and gets each of
+	// the matching ones, 1+N requests for N keys, so it's polled every DefaultPrefixPollInterval and fails if more
+	// than DefaultMaxPrefixKeys keys match unless the options say otherwise
+	WatchPrefix(ctx context.Context, prefix string, opts ...WatchOpt) <-chan ConfigEvent
+}
+
 type defaultImpl struct {
-	rpcCfg        *rpcConfig
+	// rpcCfg is the configuration file of the service, only its Service and ServiceKey are used
+	rpcCfg        *scrpc.FileConfig
 	configService config_backend.ConfigBackendService
 }
 
 func (d *defaultImpl) Get(ctx context.Context, key string) (*config_backend.GetConfigResponse, error) {
 	if d.rpcCfg == nil || d.configService == nil {
-		return nil, errors.New("empty rpcCfg or config service")
+		return nil, errEmptyConfig
 	}
 	getCfgReq := &config_backend.GetConfigRequest{
 		ServiceId:  d.rpcCfg.Service,
@@ -30,23 +48,15 @@ func (d *defaultImpl) Get(ctx context.Context, key string) (*config_backend.GetC
 	return d.configService.GetConfig(ctx, getCfgReq)
 }
 
-type rpcConfig struct {
-	Service    string `yaml:"service"`
-	ServiceKey string `yaml:"serviceKey"`
-}
-
 var serviceConfig ServiceConfig
 
 func init() {
-	scrpcFile := ".scrpc.yml"
-	var err error
-	var file *os.File
-	file, err = os.Open(scrpcFile)
+	// the file is the one configuring the client and the server, see scrpc.FileConfig
+	cfg, err := scrpc.ReadConfigFile(scrpc.DefaultConfigFile)
 	if err != nil {
-		return
-	}
-	var cfg *rpcConfig
-	if err = yaml.NewDecoder(file).Decode(&cfg); err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logrus.Errorf("[init] read %s failed, the config backend can't be used: %v", scrpc.DefaultConfigFile, err)
+		}
 		return
 	}
 	serviceConfig = &defaultImpl{
@@ -55,6 +65,19 @@ func init() {
 	}
 }
 
+// GetConfigClient returns the ServiceConfig of the service set in .scrpc.yml. Each Get asks the config backend,
+// callers reading configuration per request should move to GetCachedConfigClient, which serves the same values
+// from memory and watches alike: replacing GetConfigClient().Get by GetCachedConfigClient().Get is enough
 func GetConfigClient() ServiceConfig {
 	return serviceConfig
 }
+
+// GetConfigWatcher returns the Watcher of GetConfigClient, its watches only report errors if .scrpc.yml
+// couldn't be read
+func GetConfigWatcher() Watcher {
+	if w, ok := serviceConfig.(Watcher); ok {
+		return w
+	}
+
+	return &defaultImpl{}
+}
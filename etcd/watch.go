@@ -0,0 +1,221 @@
+package etcd
+
+import (
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	config_backend "github.com/victor-leee/scrpc/github.com/victor-leee/config-backend"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultPollInterval is the default interval at which a watched key is fetched
+	DefaultPollInterval = 5 * time.Second
+	// DefaultPrefixPollInterval is the default interval at which the keys of a watched prefix are fetched
+	DefaultPrefixPollInterval = 30 * time.Second
+	// DefaultMaxPrefixKeys is the default number of keys a watched prefix may match
+	DefaultMaxPrefixKeys = 100
+)
+
+type EventType int8
+
+const (
+	// EventPut is reported when a key is created or its value changes
+	EventPut EventType = iota
+	// EventDelete is reported when a key disappears
+	EventDelete
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventPut:
+		return "PUT"
+	case EventDelete:
+		return "DELETE"
+	default:
+		return fmt.Sprintf("EventType(%d)", t)
+	}
+}
+
+// ConfigEvent is a change of a watched key
+type ConfigEvent struct {
+	Type  EventType
+	Key   string
+	Value string
+}
+
+type watchOptions struct {
+	pollInterval time.Duration
+	maxKeys      int
+}
+
+type WatchOpt func(opts *watchOptions)
+
+// PollInterval sets the interval at which the watched keys are fetched, DefaultPollInterval by default and
+// DefaultPrefixPollInterval for prefixes
+func PollInterval(d time.Duration) WatchOpt {
+	return func(opts *watchOptions) {
+		if d > 0 {
+			opts.pollInterval = d
+		}
+	}
+}
+
+// MaxPrefixKeys sets the number of keys a watched prefix may match, DefaultMaxPrefixKeys by default. A poll
+// matching more keys fails without getting their values
+func MaxPrefixKeys(n int) WatchOpt {
+	return func(opts *watchOptions) {
+		if n > 0 {
+			opts.maxKeys = n
+		}
+	}
+}
+
+func newWatchOptions(pollInterval time.Duration, opts []WatchOpt) *watchOptions {
+	watchOpts := &watchOptions{
+		pollInterval: pollInterval,
+		maxKeys:      DefaultMaxPrefixKeys,
+	}
+	for _, opt := range opts {
+		opt(watchOpts)
+	}
+
+	return watchOpts
+}
+
+// snapshot holds the values of the watched keys
+type snapshot map[string]string
+
+// diff returns the events turning s into next, sorted by key
+func (s snapshot) diff(next snapshot) []ConfigEvent {
+	var events []ConfigEvent
+	for key, value := range next {
+		if previous, ok := s[key]; !ok || previous != value {
+			events = append(events, ConfigEvent{Type: EventPut, Key: key, Value: value})
+		}
+	}
+	for key := range s {
+		if _, ok := next[key]; !ok {
+			events = append(events, ConfigEvent{Type: EventDelete, Key: key})
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Key < events[j].Key
+	})
+
+	return events
+}
+
+func (d *defaultImpl) Watch(ctx context.Context, key string, opts ...WatchOpt) <-chan ConfigEvent {
+	return d.watch(ctx, newWatchOptions(DefaultPollInterval, opts), func(ctx context.Context) (snapshot, error) {
+		resp, err := d.Get(ctx, key)
+		if err = checkResponse(resp.GetBaseResponse(), err); err != nil {
+			return nil, err
+		}
+		if !resp.KeyExist {
+			return snapshot{}, nil
+		}
+
+		return snapshot{key: resp.Value}, nil
+	})
+}
+
+func (d *defaultImpl) WatchPrefix(ctx context.Context, prefix string, opts ...WatchOpt) <-chan ConfigEvent {
+	watchOpts := newWatchOptions(DefaultPrefixPollInterval, opts)
+	return d.watch(ctx, watchOpts, func(ctx context.Context) (snapshot, error) {
+		keys, err := d.getAllKeys(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var matched []string
+		for _, key := range keys {
+			if strings.HasPrefix(key, prefix) {
+				matched = append(matched, key)
+			}
+		}
+		if len(matched) > watchOpts.maxKeys {
+			return nil, fmt.Errorf("prefix %q matches %d keys, more than %d", prefix, len(matched), watchOpts.maxKeys)
+		}
+		values := make(snapshot, len(matched))
+		for _, key := range matched {
+			resp, getErr := d.Get(ctx, key)
+			if getErr = checkResponse(resp.GetBaseResponse(), getErr); getErr != nil {
+				return nil, getErr
+			}
+			// the key may have been deleted since it was listed
+			if resp.KeyExist {
+				values[key] = resp.Value
+			}
+		}
+
+		return values, nil
+	})
+}
+
+// watch polls fetch and reports the differences between its successive results, a failed poll is skipped
+// so the changes are reported by the next successful one
+func (d *defaultImpl) watch(ctx context.Context, watchOpts *watchOptions, fetch func(ctx context.Context) (snapshot, error)) <-chan ConfigEvent {
+	events := make(chan ConfigEvent)
+
+	go func() {
+		defer close(events)
+		ticker := time.NewTicker(watchOpts.pollInterval)
+		defer ticker.Stop()
+
+		current := snapshot{}
+		for {
+			next, err := fetch(ctx)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				logrus.Warnf("[Watcher.watch] poll failed: %v", err)
+			} else {
+				for _, event := range current.diff(next) {
+					select {
+					case events <- event:
+					case <-ctx.Done():
+						return
+					}
+				}
+				current = next
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return events
+}
+
+func (d *defaultImpl) getAllKeys(ctx context.Context) ([]string, error) {
+	if d.rpcCfg == nil || d.configService == nil {
+		return nil, errEmptyConfig
+	}
+	resp, err := d.configService.GetAllKeys(ctx, &config_backend.GetAllKeysRequest{
+		ServiceId:  d.rpcCfg.Service,
+		ServiceKey: d.rpcCfg.ServiceKey,
+	})
+	if err = checkResponse(resp.GetBaseResponse(), err); err != nil {
+		return nil, err
+	}
+
+	return resp.Keys, nil
+}
+
+// checkResponse returns err, or the error reported by base if it's not a success
+func checkResponse(base *config_backend.BaseResponse, err error) error {
+	if err != nil {
+		return err
+	}
+	if code := base.GetErrCode(); code != config_backend.ErrorCode_SUCCESS {
+		return fmt.Errorf("config backend failed with %s: %s", code, base.GetErrMsg())
+	}
+
+	return nil
+}
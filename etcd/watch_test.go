@@ -0,0 +1,221 @@
+package etcd
+
+import (
+	"context"
+	"github.com/victor-leee/scrpc"
+	config_backend "github.com/victor-leee/scrpc/github.com/victor-leee/config-backend"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testPollInterval = 5 * time.Millisecond
+
+// fakeBackend is a config backend serving the values of one service from memory
+type fakeBackend struct {
+	mux    sync.Mutex
+	values map[string]string
+	// gets and lists count the GetConfig and GetAllKeys calls
+	gets  int
+	lists int
+}
+
+func newFakeWatcher(values map[string]string) (*defaultImpl, *fakeBackend) {
+	backend := &fakeBackend{values: values}
+	return &defaultImpl{
+		rpcCfg:        &scrpc.FileConfig{Service: "svc", ServiceKey: "key"},
+		configService: backend,
+	}, backend
+}
+
+func (f *fakeBackend) GetConfig(_ context.Context, req *config_backend.GetConfigRequest) (*config_backend.GetConfigResponse, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	f.gets++
+	value, exists := f.values[req.Key]
+	return &config_backend.GetConfigResponse{
+		BaseResponse: &config_backend.BaseResponse{ErrCode: config_backend.ErrorCode_SUCCESS},
+		KeyExist:     exists,
+		Value:        value,
+	}, nil
+}
+
+func (f *fakeBackend) PutConfig(context.Context, *config_backend.PutConfigRequest) (*config_backend.PutConfigResponse, error) {
+	return &config_backend.PutConfigResponse{
+		BaseResponse: &config_backend.BaseResponse{ErrCode: config_backend.ErrorCode_ERR_INTERNAL_SERVER_ERROR},
+	}, nil
+}
+
+func (f *fakeBackend) GetAllKeys(context.Context, *config_backend.GetAllKeysRequest) (*config_backend.GetAllKeysResponse, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	f.lists++
+	keys := make([]string, 0, len(f.values))
+	for key := range f.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return &config_backend.GetAllKeysResponse{
+		BaseResponse: &config_backend.BaseResponse{ErrCode: config_backend.ErrorCode_SUCCESS},
+		Keys:         keys,
+	}, nil
+}
+
+// update changes the values at once, so a poll sees all the changes or none
+func (f *fakeBackend) update(change func(values map[string]string)) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	change(f.values)
+}
+
+func (f *fakeBackend) counts() (gets, lists int) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	return f.gets, f.lists
+}
+
+// receive returns the next n events of events
+func receive(t *testing.T, events <-chan ConfigEvent, n int) []ConfigEvent {
+	t.Helper()
+	var received []ConfigEvent
+	timeout := time.After(5 * time.Second)
+	for len(received) < n {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				t.Fatalf("the channel closed after %v", received)
+			}
+			received = append(received, event)
+		case <-timeout:
+			t.Fatalf("got %v, expected %d events", received, n)
+		}
+	}
+
+	return received
+}
+
+func assertEvents(t *testing.T, got []ConfigEvent, expected ...ConfigEvent) {
+	t.Helper()
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("got events %v, expected %v", got, expected)
+	}
+}
+
+func TestWatchReportsChanges(t *testing.T) {
+	w, backend := newFakeWatcher(map[string]string{"other": "x"})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := w.Watch(ctx, "k", PollInterval(testPollInterval))
+
+	// a missing key isn't reported until it's created
+	backend.update(func(values map[string]string) { values["k"] = "v1" })
+	assertEvents(t, receive(t, events, 1), ConfigEvent{Type: EventPut, Key: "k", Value: "v1"})
+	backend.update(func(values map[string]string) { values["k"] = "v2" })
+	assertEvents(t, receive(t, events, 1), ConfigEvent{Type: EventPut, Key: "k", Value: "v2"})
+	backend.update(func(values map[string]string) { delete(values, "k") })
+	assertEvents(t, receive(t, events, 1), ConfigEvent{Type: EventDelete, Key: "k"})
+}
+
+func TestWatchPrefixDiffsSnapshots(t *testing.T) {
+	w, backend := newFakeWatcher(map[string]string{"app.b": "2", "app.a": "1", "other": "x"})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := w.WatchPrefix(ctx, "app.", PollInterval(testPollInterval))
+
+	// the first events carry the current values
+	assertEvents(t, receive(t, events, 2),
+		ConfigEvent{Type: EventPut, Key: "app.a", Value: "1"},
+		ConfigEvent{Type: EventPut, Key: "app.b", Value: "2"})
+
+	backend.update(func(values map[string]string) {
+		values["app.a"] = "3"
+		delete(values, "app.b")
+		values["app.c"] = "4"
+		values["other"] = "y"
+	})
+	assertEvents(t, receive(t, events, 3),
+		ConfigEvent{Type: EventPut, Key: "app.a", Value: "3"},
+		ConfigEvent{Type: EventDelete, Key: "app.b"},
+		ConfigEvent{Type: EventPut, Key: "app.c", Value: "4"})
+
+	// an unchanged value isn't reported again
+	backend.update(func(values map[string]string) { values["app.d"] = "5" })
+	assertEvents(t, receive(t, events, 1), ConfigEvent{Type: EventPut, Key: "app.d", Value: "5"})
+}
+
+func TestWatchPrefixLimitsKeys(t *testing.T) {
+	w, backend := newFakeWatcher(map[string]string{"app.a": "1", "app.b": "2", "app.c": "3"})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := w.WatchPrefix(ctx, "app.", PollInterval(testPollInterval), MaxPrefixKeys(2))
+
+	// the polls fail without getting the values while too many keys match
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, lists := backend.counts(); lists >= 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the prefix wasn't polled")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if gets, _ := backend.counts(); gets != 0 {
+		t.Fatalf("got %d values of a prefix matching too many keys", gets)
+	}
+	select {
+	case event := <-events:
+		t.Fatalf("got %v while too many keys match", event)
+	default:
+	}
+
+	backend.update(func(values map[string]string) { delete(values, "app.c") })
+	assertEvents(t, receive(t, events, 2),
+		ConfigEvent{Type: EventPut, Key: "app.a", Value: "1"},
+		ConfigEvent{Type: EventPut, Key: "app.b", Value: "2"})
+}
+
+func TestWatchClosesOnCancel(t *testing.T) {
+	w, _ := newFakeWatcher(map[string]string{"app.a": "1", "app.b": "2"})
+	ctx, cancel := context.WithCancel(context.Background())
+	events := w.WatchPrefix(ctx, "app.", PollInterval(testPollInterval))
+	receive(t, events, 1)
+
+	// the watch stops even though its event isn't read
+	cancel()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("the channel wasn't closed after the cancellation")
+		}
+	}
+}
+
+func TestWatchWithoutConfigFile(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	events := (&defaultImpl{}).Watch(ctx, "k", PollInterval(testPollInterval))
+
+	// the polls fail, nothing is reported until the watch stops
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	select {
+	case event, ok := <-events:
+		if ok {
+			t.Fatalf("got %v without a config file", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the channel wasn't closed after the cancellation")
+	}
+}
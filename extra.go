@@ -0,0 +1,101 @@
+package scrpc
+
+import (
+	"context"
+	"github.com/victor-leee/scrpc/github.com/victor-leee/scrpc"
+	"github.com/victor-leee/scrpc/metadata"
+	"strings"
+	"sync"
+)
+
+// errorExtraKey is the key of Header.Extra carrying the error returned by a handler
+const errorExtraKey = metadata.ReservedPrefix + "error"
+
+// ErrorHeader returns the header of the answer to the unary request req failing with err,
+// the caller of the request fails with ErrRemote
+func ErrorHeader(req *scrpc.Header, err error) *scrpc.Header {
+	return &scrpc.Header{
+		TraceId: req.TraceId,
+		SpanId:  req.SpanId,
+		Extra: map[string]string{
+			errorExtraKey: err.Error(),
+		},
+	}
+}
+
+// fillMetadata copies the outgoing metadata of ctx into the Extra of an outbound header
+func fillMetadata(ctx context.Context, header *scrpc.Header) error {
+	md, ok := metadata.FromOutgoingContext(ctx)
+	if !ok {
+		return nil
+	}
+	if err := md.Validate(); err != nil {
+		return err
+	}
+	for k, v := range md {
+		header.Extra[k] = v
+	}
+
+	return nil
+}
+
+// incomingMetadata extracts the metadata of an inbound header, keys reserved for scrpc are left out
+func incomingMetadata(header *scrpc.Header) metadata.MD {
+	md := make(metadata.MD, len(header.Extra))
+	for k, v := range header.Extra {
+		if strings.HasPrefix(k, metadata.ReservedPrefix) {
+			continue
+		}
+		md[k] = v
+	}
+
+	return md
+}
+
+type responseHeaderKey struct{}
+
+// responseHeader collects the metadata set by a handler, it's sent in the Extra of the response
+type responseHeader struct {
+	mux sync.Mutex
+	md  metadata.MD
+}
+
+func (r *responseHeader) extra() map[string]string {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	return r.md.Copy()
+}
+
+func contextWithResponseHeader(ctx context.Context) (context.Context, *responseHeader) {
+	rh := &responseHeader{
+		md: metadata.MD{},
+	}
+
+	return context.WithValue(ctx, responseHeaderKey{}, rh), rh
+}
+
+// SetHeader attaches md to the response of the request being served, it must be called with the context
+// passed to the handler and multiple calls are merged
+func SetHeader(ctx context.Context, md metadata.MD) error {
+	rh, ok := ctx.Value(responseHeaderKey{}).(*responseHeader)
+	if !ok {
+		return ErrNotInHandler
+	}
+	if err := md.Validate(); err != nil {
+		return err
+	}
+
+	rh.mux.Lock()
+	defer rh.mux.Unlock()
+	merged := rh.md.Copy()
+	for k, v := range md {
+		merged.Set(k, v)
+	}
+	if err := merged.Validate(); err != nil {
+		return err
+	}
+	rh.md = merged
+
+	return nil
+}
@@ -13,7 +13,7 @@ import (
 var client scrpc.Client
 
 func init() {
-	client = scrpc.NewClient()
+	client, _ = scrpc.NewClient()
 }
 
 type ConfigBackendService interface {
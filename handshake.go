@@ -0,0 +1,193 @@
+package scrpc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	// ProtocolVersion is the newest version of the wire protocol spoken by this package
+	ProtocolVersion uint16 = 1
+	// MinProtocolVersion is the oldest version of the wire protocol spoken by this package
+	MinProtocolVersion uint16 = 1
+)
+
+// protocolMagic starts the preamble of every connection, a peer sending anything else doesn't speak scrpc
+var protocolMagic = [4]byte{'S', 'C', 'R', 'P'}
+
+// preambleSize is the size of the magic, the max and min versions and the features
+const preambleSize = 4 + 2 + 2 + 4
+
+// handshakeTimeout is the default bound of the exchange of the preambles
+const handshakeTimeout = 5 * time.Second
+
+// Feature is an optional feature of the wire protocol, the features of a connection are the ones both peers support
+type Feature uint32
+
+const (
+	FeatureCompression Feature = 1 << iota
+	FeatureCodecs
+	FeatureStreams
+	FeatureBatch
+	FeatureOneWay
+	// FeatureChecksum allows frames to be followed by a CRC32C trailer
+	FeatureChecksum
+)
+
+// SupportedFeatures are the features implemented by this package, they are advertised by default
+const SupportedFeatures = FeatureCompression | FeatureCodecs | FeatureStreams | FeatureBatch | FeatureOneWay |
+	FeatureChecksum
+
+// Has reports whether all of features are set
+func (f Feature) Has(features Feature) bool {
+	return f&features == features
+}
+
+// Protocol is the result of the handshake of a connection, the zero value means the handshake was skipped
+type Protocol struct {
+	Version  uint16
+	Features Feature
+}
+
+type preamble struct {
+	maxVersion uint16
+	minVersion uint16
+	features   Feature
+}
+
+func localPreamble(features Feature) preamble {
+	return preamble{
+		maxVersion: ProtocolVersion,
+		minVersion: MinProtocolVersion,
+		features:   features & SupportedFeatures,
+	}
+}
+
+func (p preamble) write(w io.Writer) error {
+	b := make([]byte, preambleSize)
+	copy(b, protocolMagic[:])
+	binary.LittleEndian.PutUint16(b[4:], p.maxVersion)
+	binary.LittleEndian.PutUint16(b[6:], p.minVersion)
+	binary.LittleEndian.PutUint32(b[8:], uint32(p.features))
+	_, err := w.Write(b)
+
+	return err
+}
+
+func readPreamble(r io.Reader) (preamble, error) {
+	b := make([]byte, preambleSize)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return preamble{}, err
+	}
+	if [4]byte{b[0], b[1], b[2], b[3]} != protocolMagic {
+		return preamble{}, fmt.Errorf("%w: bad magic %q", ErrProtocolMismatch, b[:4])
+	}
+
+	return preamble{
+		maxVersion: binary.LittleEndian.Uint16(b[4:]),
+		minVersion: binary.LittleEndian.Uint16(b[6:]),
+		features:   Feature(binary.LittleEndian.Uint32(b[8:])),
+	}, nil
+}
+
+// negotiate picks the newest version both local and remote speak, both peers come to the same result
+func negotiate(local, remote preamble) (Protocol, error) {
+	version := local.maxVersion
+	if remote.maxVersion < version {
+		version = remote.maxVersion
+	}
+	if version < local.minVersion || version < remote.minVersion {
+		return Protocol{}, fmt.Errorf("%w: local versions %d-%d, remote versions %d-%d", ErrProtocolMismatch,
+			local.minVersion, local.maxVersion, remote.minVersion, remote.maxVersion)
+	}
+
+	return Protocol{
+		Version:  version,
+		Features: local.features & remote.features,
+	}, nil
+}
+
+// handshake exchanges the preambles of the connection, the dialer writes first and the acceptor reads first
+// so that the acceptor never answers a peer which doesn't speak scrpc
+func (c *Conn) handshake(dialer bool) error {
+	if c.handshakeTimeout > 0 {
+		if err := c.NetConn.SetDeadline(time.Now().Add(c.handshakeTimeout)); err != nil {
+			return err
+		}
+	}
+	if !dialer {
+		legacy, err := c.legacyDialer()
+		if err != nil {
+			return err
+		}
+		if legacy {
+			// nothing was consumed, the connection is served with the legacy framing and the zero Protocol
+			return c.NetConn.SetDeadline(time.Time{})
+		}
+	}
+	local := localPreamble(c.features)
+	if dialer {
+		if err := local.write(c.NetConn); err != nil {
+			return err
+		}
+	}
+	remote, err := readPreamble(c)
+	if err != nil {
+		return err
+	}
+	if !dialer {
+		// the preamble is answered even if the versions mismatch, so the dialer can report the mismatch as well
+		if err = local.write(c.NetConn); err != nil {
+			return err
+		}
+	}
+	if c.protocol, err = negotiate(local, remote); err != nil {
+		return err
+	}
+
+	return c.NetConn.SetDeadline(time.Time{})
+}
+
+// legacyDialer reports whether the dialer of an accepted connection skipped the handshake, it starts with a frame
+// instead of the magic or stays silent until the handshake timeout like the idle connections of a pool
+func (c *Conn) legacyDialer() (bool, error) {
+	magic, err := c.reader.Peek(len(protocolMagic))
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return !bytes.Equal(magic, protocolMagic[:]), nil
+}
+
+// AcceptHandshake performs the handshake of a connection returned by Listener.Accept, it's separated from Accept
+// so that a slow peer doesn't block the accept loop. The connection is closed if the handshake fails.
+// It's a no-op if the handshake is disabled on the listener, dialers which don't start the handshake are detected
+// and served with the legacy framing
+func (c *Conn) AcceptHandshake() error {
+	if !c.handshakeEnabled {
+		return nil
+	}
+	if err := c.handshake(false); err != nil {
+		if closeErr := c.Close(); closeErr != nil {
+			logrus.Warnf("[AcceptHandshake] close connection failed: %v", closeErr)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Protocol returns the negotiated protocol of the connection
+func (c *Conn) Protocol() Protocol {
+	return c.protocol
+}
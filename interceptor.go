@@ -0,0 +1,67 @@
+package scrpc
+
+import (
+	"context"
+	"github.com/victor-leee/scrpc/github.com/victor-leee/scrpc"
+	"google.golang.org/protobuf/proto"
+	"sync"
+)
+
+// Invoker sends req with header to the side-car and fills resp with the response,
+// resp is nil for one-way requests which return once req is written
+type Invoker func(ctx context.Context, header *scrpc.Header, req, resp proto.Message) error
+
+// ClientInterceptor intercepts every unary request sent by a client, header is the outbound header and may be
+// modified before calling invoker, which must be called to continue the request
+type ClientInterceptor func(ctx context.Context, header *scrpc.Header, req, resp proto.Message, invoker Invoker) error
+
+// ServerInterceptor intercepts every request served by a server, header is the inbound header and handler
+// must be called to continue serving the request
+type ServerInterceptor func(ctx context.Context, header *scrpc.Header, body []byte, handler ContextHandler) (proto.Message, error)
+
+// StreamInterceptor is called when a client starts a stream or a batch, or when a server starts serving a stream.
+// header describes it, a client sends it once every interceptor returned so it may be modified.
+// The returned function is called with the result once the stream or the batch is over, nil if it succeeded
+type StreamInterceptor func(ctx context.Context, header *scrpc.Header) func(err error)
+
+// startStream calls interceptors in order for the stream or batch described by header, the returned function
+// reports its result to them in the reverse order. Only its first call is reported
+func startStream(ctx context.Context, interceptors []StreamInterceptor, header *scrpc.Header) func(err error) {
+	dones := make([]func(err error), 0, len(interceptors))
+	for _, interceptor := range interceptors {
+		dones = append(dones, interceptor(ctx, header))
+	}
+	var once sync.Once
+
+	return func(err error) {
+		once.Do(func() {
+			for i := len(dones) - 1; i >= 0; i-- {
+				dones[i](err)
+			}
+		})
+	}
+}
+
+// chainClientInterceptors builds an Invoker which calls interceptors in order before calling invoker
+func chainClientInterceptors(interceptors []ClientInterceptor, invoker Invoker) Invoker {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], invoker
+		invoker = func(ctx context.Context, header *scrpc.Header, req, resp proto.Message) error {
+			return interceptor(ctx, header, req, resp, next)
+		}
+	}
+
+	return invoker
+}
+
+// chainServerInterceptors builds a handler which calls interceptors in order before calling h
+func chainServerInterceptors(interceptors []ServerInterceptor, header *scrpc.Header, h ContextHandler) ContextHandler {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], h
+		h = func(ctx context.Context, b []byte) (proto.Message, error) {
+			return interceptor(ctx, header, b, next)
+		}
+	}
+
+	return h
+}
@@ -28,20 +28,35 @@ type Manager interface {
 	UpdateServerInfo(cname string, tp UpdateType) error
 	// Func is a wrapper to Put&Get&UpdateServerInfo
 	// it is recommended to use Func instead of handling Put/Get/UpdateServerInfo yourself unless
-	// absolutely necessary
+	// absolutely necessary, f calls Conn.MarkBroken if the connection must not be reused
 	Func(cname string, f func(conn *Conn) error) error
+	// Hold takes a connection out of the pool with key cname until release is called,
+	// it's used by streams which occupy a connection for their whole lifetime.
+	// release closes the connection instead of reusing it if broken is true, calling it more than once is a no-op
+	Hold(cname string) (conn *Conn, release func(broken bool), err error)
+	// PoolStats returns the stats of every known connection pool keyed by cname
+	PoolStats() map[string]PoolStats
+	// Resize changes the maximum size of the connection pool with key cname, it's a no-op if the pool doesn't exist yet
+	Resize(cname string, maxSize int) error
+	// Close closes every connection pool, the connections put back afterwards are closed and Get and Hold fail
+	// with ErrClosed
+	Close() error
 }
 
 type safeMap struct {
 	mux         sync.RWMutex
 	m           map[string]ConnPool
 	poolFactory ConnPoolFactory
+	closed      bool
 }
 
 func (m *safeMap) insert(cname string) error {
 	m.mux.Lock()
 	defer m.mux.Unlock()
 
+	if m.closed {
+		return ErrClosed
+	}
 	if m.m[cname] != nil {
 		return nil
 	}
@@ -79,14 +94,52 @@ func (m *safeMap) get(cname string) ConnPool {
 	return nil
 }
 
-func (m *safeMap) put(cname string, pool ConnPool) {
+// getOrPut returns the pool with key cname, pool is stored first if there's none
+func (m *safeMap) getOrPut(cname string, pool func() ConnPool) (ConnPool, error) {
 	m.mux.Lock()
 	defer m.mux.Unlock()
-	if m.m[cname] != nil {
-		return
+
+	if m.closed {
+		return nil, ErrClosed
+	}
+	if m.m[cname] == nil {
+		m.m[cname] = pool()
+	}
+
+	return m.m[cname], nil
+}
+
+// close closes every pool, the subsequent inserts fail with ErrClosed
+func (m *safeMap) close() error {
+	m.mux.Lock()
+	pools := m.m
+	m.m = make(map[string]ConnPool)
+	m.closed = true
+	m.mux.Unlock()
+
+	var err error
+	for cname, pl := range pools {
+		if closeErr := pl.Close(); closeErr != nil {
+			logrus.Warnf("[ConnManager.Close] close pool %s failed: %v", cname, closeErr)
+			if err == nil {
+				err = closeErr
+			}
+		}
 	}
 
-	m.m[cname] = pool
+	return err
+}
+
+func (m *safeMap) stats() map[string]PoolStats {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+
+	stats := make(map[string]PoolStats, len(m.m))
+	for cname, pl := range m.m {
+		stats[cname] = pl.Stats()
+	}
+
+	return stats
 }
 
 type pooledConnManager struct {
@@ -104,11 +157,19 @@ func InitConnManager(poolFactory ConnPoolFactory) Manager {
 }
 
 func (p *pooledConnManager) Put(cname string, conn *Conn) error {
-	if p.serviceID2Pool.get(cname) == nil {
+	pl, err := p.serviceID2Pool.getOrPut(cname, func() ConnPool {
 		pl, _ := NewGetFromPutPool()
-		p.serviceID2Pool.put(cname, pl)
+		return pl
+	})
+	if err != nil {
+		// the manager is closed, nobody takes the connection anymore
+		if closeErr := conn.Close(); closeErr != nil {
+			logrus.Warnf("[ConnManager.Put] close connection failed: %v", closeErr)
+		}
+		return nil
 	}
-	return p.serviceID2Pool.get(cname).Put(conn)
+
+	return pl.Put(conn)
 }
 
 func (p *pooledConnManager) Get(cname string) (*Conn, error) {
@@ -152,10 +213,51 @@ func (p *pooledConnManager) Func(cName string, f func(conn *Conn) error) error {
 		}
 	}
 	defer func() {
-		if err = p.Put(cName, conn); err != nil {
+		// a connection marked broken by f, e.g. after a partial write, is closed and discarded by the pool
+		if err = p.Put(cName, conn); err != nil && !conn.Broken() {
 			logrus.Errorf("[ConnManager.Func] put back connection failed: %v", err)
 		}
 	}()
 
 	return f(conn)
 }
+
+func (p *pooledConnManager) Close() error {
+	return p.serviceID2Pool.close()
+}
+
+func (p *pooledConnManager) PoolStats() map[string]PoolStats {
+	return p.serviceID2Pool.stats()
+}
+
+func (p *pooledConnManager) Resize(cname string, maxSize int) error {
+	pl := p.serviceID2Pool.get(cname)
+	if pl == nil {
+		return nil
+	}
+
+	return pl.Resize(maxSize)
+}
+
+func (p *pooledConnManager) Hold(cname string) (*Conn, func(broken bool), error) {
+	conn, err := p.Get(cname)
+	if err != nil {
+		logrus.Warnf("[ConnManager.Hold] get connection failed: %v", err)
+		return nil, nil, err
+	}
+
+	var once sync.Once
+	release := func(broken bool) {
+		once.Do(func() {
+			if broken {
+				conn.MarkBroken()
+			}
+			// a broken connection is closed and discarded by the pool, which allows a new one to be created
+			if putErr := p.Put(cname, conn); putErr != nil && !conn.Broken() {
+				logrus.Errorf("[ConnManager.Hold] put back connection failed: %v", putErr)
+			}
+		})
+	}
+
+	return conn, release, nil
+}
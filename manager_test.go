@@ -0,0 +1,68 @@
+package scrpc
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// newPipeManager returns a Manager whose pools dial one end of a net.Pipe, the other ends are sent to peers
+func newPipeManager(t *testing.T, peers chan<- net.Conn) Manager {
+	t.Helper()
+
+	return InitConnManager(func(cname string) (ConnPool, error) {
+		return NewPool(WithMaxSize(1), WithFactory(func() (*Conn, error) {
+			local, remote := net.Pipe()
+			peers <- remote
+			return NewConn(local), nil
+		}))
+	})
+}
+
+func TestManagerClosesConnPutAfterClose(t *testing.T) {
+	peers := make(chan net.Conn, 1)
+	m := newPipeManager(t, peers)
+
+	conn, release, err := m.Hold("svc")
+	if err != nil {
+		t.Fatalf("hold failed: %v", err)
+	}
+	peer := <-peers
+	if err = m.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+	release(false)
+
+	// the connection put back after Close is closed, so its peer reads EOF
+	if _, err = peer.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("got %v reading the peer, expected EOF", err)
+	}
+	if _, err = conn.Write([]byte{0}); err == nil {
+		t.Fatal("connection still writable after it was put back")
+	}
+	if stats := m.PoolStats(); len(stats) != 0 {
+		t.Errorf("got pools %v after Close, expected none", stats)
+	}
+}
+
+func TestManagerFailsAfterClose(t *testing.T) {
+	m := newPipeManager(t, make(chan net.Conn, 1))
+	if err := m.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	if _, err := m.Get("svc"); !errors.Is(err, ErrClosed) {
+		t.Errorf("Get got %v, expected ErrClosed", err)
+	}
+	if _, _, err := m.Hold("svc"); !errors.Is(err, ErrClosed) {
+		t.Errorf("Hold got %v, expected ErrClosed", err)
+	}
+	err := m.Func("svc", func(*Conn) error {
+		t.Error("Func called f after Close")
+		return nil
+	})
+	if !errors.Is(err, ErrClosed) {
+		t.Errorf("Func got %v, expected ErrClosed", err)
+	}
+}
@@ -2,12 +2,65 @@ package scrpc
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"github.com/sirupsen/logrus"
+	"github.com/victor-leee/scrpc/codec"
 	"github.com/victor-leee/scrpc/github.com/victor-leee/scrpc"
 	"google.golang.org/protobuf/proto"
+	"hash/crc32"
 	"io"
+	"net"
+	"sync"
 )
 
+// headerLenSize is the size of the little-endian length prefixing the header of a message
+const headerLenSize = 8
+
+const (
+	// DefaultMaxHeaderSize is the default limit of the size of the header of a message read
+	DefaultMaxHeaderSize = 64 << 10
+	// DefaultMaxBodySize is the default limit of the size of the body of a message read, before and after decompression
+	DefaultMaxBodySize = 16 << 20
+)
+
+// checksumSize is the size of the CRC32C trailer of a frame whose header has checksum set
+const checksumSize = 4
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// maxDrainSize is the size up to which an oversized body is discarded to keep the connection in sync,
+// the connection is closed if the body is larger
+const maxDrainSize = 64 << 20
+
+// maxPooledBufferSize is the capacity above which buffers are left to the garbage collector
+const maxPooledBufferSize = 1 << 20
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 4<<10)
+		return &b
+	},
+}
+
+// getBuffer returns a pooled buffer of length size, it must be released by putBuffer once unused
+func getBuffer(size int) *[]byte {
+	b := bufferPool.Get().(*[]byte)
+	if cap(*b) < size {
+		*b = make([]byte, size)
+	}
+	*b = (*b)[:size]
+
+	return b
+}
+
+func putBuffer(b *[]byte) {
+	if cap(*b) > maxPooledBufferSize {
+		return
+	}
+	bufferPool.Put(b)
+}
+
 // Message holds the data transferred through unix domain sock and sends them to other side-cars
 type Message struct {
 	HeaderLenBytes []byte
@@ -33,29 +86,125 @@ func FromBody(body []byte, customHeader *scrpc.Header) *Message {
 		ReceiverServiceName: customHeader.ReceiverServiceName,
 		ReceiverMethodName:  customHeader.ReceiverMethodName,
 		TraceId:             customHeader.TraceId,
+		SpanId:              customHeader.SpanId,
+		ParentSpanId:        customHeader.ParentSpanId,
+		StreamId:            customHeader.StreamId,
+		WindowSize:          customHeader.WindowSize,
+		OneWay:              customHeader.OneWay,
+		Compression:         customHeader.Compression,
+		Compressed:          customHeader.Compressed,
+		Codec:               customHeader.Codec,
+		Checksum:            customHeader.Checksum,
 		Extra:               customHeader.Extra,
 	}
-	headerBytes, _ := proto.Marshal(header)
-	headerLenBytes := make([]byte, 8)
-	binary.LittleEndian.PutUint64(headerLenBytes, uint64(len(headerBytes)))
+	// the length and the header share one allocation
+	frame := make([]byte, headerLenSize, headerLenSize+proto.Size(header))
+	frame, _ = proto.MarshalOptions{}.MarshalAppend(frame, header)
+	binary.LittleEndian.PutUint64(frame, uint64(len(frame)-headerLenSize))
 
 	return &Message{
-		HeaderLenBytes: headerLenBytes,
+		HeaderLenBytes: frame[:headerLenSize],
 		Header:         header,
-		RawHeader:      headerBytes,
+		RawHeader:      frame[headerLenSize:],
 		Body:           body,
 	}
 }
 
-// FromReader builds a Message by calling readFunc on reader for multiple times
-func FromReader(reader io.Reader, readFunc func(reader io.Reader, size uint64) ([]byte, error)) (*Message, error) {
+type readLimits struct {
+	maxHeaderSize uint64
+	maxBodySize   uint64
+}
+
+// ReadOpt sets a limit of the messages read by FromReader and ReadMessage
+type ReadOpt func(limits *readLimits)
+
+// MaxHeaderSize limits the size of the header of the message read, DefaultMaxHeaderSize by default
+func MaxHeaderSize(n uint64) ReadOpt {
+	return func(limits *readLimits) {
+		limits.maxHeaderSize = n
+	}
+}
+
+// MaxBodySize limits the size of the body of the message read, DefaultMaxBodySize by default
+func MaxBodySize(n uint64) ReadOpt {
+	return func(limits *readLimits) {
+		limits.maxBodySize = n
+	}
+}
+
+// newReadLimits applies the limits of reader if it's a *Conn, then opts
+func newReadLimits(reader io.Reader, opts []ReadOpt) *readLimits {
+	limits := &readLimits{
+		maxHeaderSize: DefaultMaxHeaderSize,
+		maxBodySize:   DefaultMaxBodySize,
+	}
+	if conn, ok := reader.(*Conn); ok {
+		for _, opt := range conn.readOpts {
+			opt(limits)
+		}
+	}
+	for _, opt := range opts {
+		opt(limits)
+	}
+
+	return limits
+}
+
+// frameChecksum is the CRC32C of a frame as written on the wire, body is the body before decompression
+func frameChecksum(headerLenBytes, rawHeader, body []byte) uint32 {
+	crc := crc32.Update(0, castagnoli, headerLenBytes)
+	crc = crc32.Update(crc, castagnoli, rawHeader)
+
+	return crc32.Update(crc, castagnoli, body)
+}
+
+// verifyChecksum compares trailer with the checksum of the frame, reader is closed on mismatch since it
+// can't be trusted to be in sync anymore
+func verifyChecksum(reader io.Reader, trailer, headerLenBytes, rawHeader, body []byte) error {
+	expected := binary.LittleEndian.Uint32(trailer)
+	if actual := frameChecksum(headerLenBytes, rawHeader, body); actual != expected {
+		if closer, ok := reader.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				logrus.Warnf("[verifyChecksum] close reader failed: %v", err)
+			}
+		}
+		return fmt.Errorf("%w: checksum %08x, expected %08x", ErrCorruptFrame, actual, expected)
+	}
+
+	return nil
+}
+
+// rejectOversized discards the n bytes of an oversized part of a message from reader so the next message can be
+// read, reader is closed instead if it's too large to discard or its whole header can't be read
+func rejectOversized(reader io.Reader, n uint64, discard bool) {
+	if discard && n <= maxDrainSize {
+		if _, err := io.CopyN(io.Discard, reader, int64(n)); err == nil {
+			return
+		}
+	}
+	if closer, ok := reader.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			logrus.Warnf("[rejectOversized] close reader failed: %v", err)
+		}
+	}
+}
+
+// FromReader builds a Message by calling readFunc on reader for multiple times,
+// ReadMessage is preferred unless a custom readFunc is required.
+// ErrMessageTooLarge and ErrCorruptFrame are returned like ReadMessage does
+func FromReader(reader io.Reader, readFunc func(reader io.Reader, size uint64) ([]byte, error), opts ...ReadOpt) (*Message, error) {
+	limits := newReadLimits(reader, opts)
 	// first block read the first 8 bytes, which is the length of the header
-	headerLenBytes, err := readFunc(reader, 8)
+	headerLenBytes, err := readFunc(reader, headerLenSize)
 	if err != nil {
 		logrus.Errorf("[FromReader] read header length bytes failed: %v", err)
 		return nil, err
 	}
 	headerLen := binary.LittleEndian.Uint64(headerLenBytes)
+	if headerLen > limits.maxHeaderSize {
+		rejectOversized(reader, headerLen, false)
+		return nil, fmt.Errorf("%w: header of %d bytes exceeds %d", ErrMessageTooLarge, headerLen, limits.maxHeaderSize)
+	}
 	// then block read the header with length of headerLen
 	headerBytes, err := readFunc(reader, headerLen)
 	if err != nil {
@@ -67,48 +216,241 @@ func FromReader(reader io.Reader, readFunc func(reader io.Reader, size uint64) (
 		logrus.Errorf("[FromReader] unmarshal bytes to struct Header failed: %v", err)
 		return nil, err
 	}
+	msg := &Message{
+		HeaderLenBytes: headerLenBytes,
+		Header:         header,
+		RawHeader:      headerBytes,
+	}
+	if header.BodySize > limits.maxBodySize {
+		rejectOversized(reader, header.BodySize+trailerSize(header), true)
+		return msg, bodyTooLarge(header.BodySize, limits)
+	}
 	// eventually read the body bytes
 	body, err := readFunc(reader, header.BodySize)
 	if err != nil {
 		logrus.Errorf("[FromReader] reader body failed: %v", err)
 		return nil, err
 	}
+	if header.Checksum {
+		trailer, trailerErr := readFunc(reader, checksumSize)
+		if trailerErr != nil {
+			logrus.Errorf("[FromReader] read checksum failed: %v", trailerErr)
+			return nil, trailerErr
+		}
+		if err = verifyChecksum(reader, trailer, headerLenBytes, headerBytes, body); err != nil {
+			logrus.Errorf("[FromReader] %v", err)
+			return nil, err
+		}
+	}
+	if header.Compressed {
+		if body, err = decompressBody(header.Compression, body, limits.maxBodySize); err != nil {
+			logrus.Errorf("[FromReader] decompress body failed: %v", err)
+			if errors.Is(err, ErrMessageTooLarge) {
+				// the whole frame was read, the reader is still in sync
+				return msg, err
+			}
+			return nil, err
+		}
+	}
+	msg.Body = body
 
-	return &Message{
-		HeaderLenBytes: headerLenBytes,
-		Header:         header,
-		RawHeader:      headerBytes,
-		Body:           body,
-	}, nil
+	return msg, nil
 }
 
-func (m *Message) Write(writer io.Writer) (int, error) {
-	var (
-		nWrite int
-		nInc   int
-		err    error
-	)
+// trailerSize is the size of what follows the body of the frame of header
+func trailerSize(header *scrpc.Header) uint64 {
+	if header.Checksum {
+		return checksumSize
+	}
+
+	return 0
+}
+
+func bodyTooLarge(size uint64, limits *readLimits) error {
+	return fmt.Errorf("%w: body of %d bytes exceeds %d", ErrMessageTooLarge, size, limits.maxBodySize)
+}
 
-	nInc, err = writer.Write(m.HeaderLenBytes)
+// ReadMessage reads a Message from reader with io.ReadFull. The length and the header of the message share one
+// allocation and compressed bodies are read into pooled buffers, which are recycled once decompressed.
+// If reader is a *Conn its read options apply before opts.
+//
+// ErrMessageTooLarge is returned if a limit is exceeded. An oversized body is discarded and the message is returned
+// without its body along with the error, so the reader stays usable. Otherwise reader is closed if it's an io.Closer.
+// ErrCorruptFrame is returned and reader is closed if the frame has a checksum which doesn't match
+func ReadMessage(reader io.Reader, opts ...ReadOpt) (*Message, error) {
+	limits := newReadLimits(reader, opts)
+	lenBuf := getBuffer(headerLenSize)
+	_, err := io.ReadFull(reader, *lenBuf)
+	headerLen := binary.LittleEndian.Uint64(*lenBuf)
+	putBuffer(lenBuf)
 	if err != nil {
-		logrus.Errorf("[Message.Write] write header length bytes failed: %v", err)
-		return 0, err
+		logrus.Errorf("[ReadMessage] read header length bytes failed: %v", err)
+		return nil, err
+	}
+	if headerLen > limits.maxHeaderSize {
+		rejectOversized(reader, headerLen, false)
+		return nil, fmt.Errorf("%w: header of %d bytes exceeds %d", ErrMessageTooLarge, headerLen, limits.maxHeaderSize)
 	}
-	nWrite += nInc
 
-	nInc, err = writer.Write(m.RawHeader)
+	frame := make([]byte, headerLenSize+headerLen)
+	binary.LittleEndian.PutUint64(frame, headerLen)
+	if _, err = io.ReadFull(reader, frame[headerLenSize:]); err != nil {
+		logrus.Errorf("[ReadMessage] read header bytes failed: %v", err)
+		return nil, err
+	}
+	header := &scrpc.Header{}
+	if err = proto.Unmarshal(frame[headerLenSize:], header); err != nil {
+		logrus.Errorf("[ReadMessage] unmarshal bytes to struct Header failed: %v", err)
+		return nil, err
+	}
+
+	msg := &Message{
+		HeaderLenBytes: frame[:headerLenSize],
+		Header:         header,
+		RawHeader:      frame[headerLenSize:],
+	}
+	if header.BodySize > limits.maxBodySize {
+		rejectOversized(reader, header.BodySize+trailerSize(header), true)
+		return msg, bodyTooLarge(header.BodySize, limits)
+	}
+
+	var body []byte
+	if header.Compressed {
+		compressed := getBuffer(int(header.BodySize))
+		if err = readBody(reader, msg, *compressed); err == nil {
+			body, err = decompressBody(header.Compression, *compressed, limits.maxBodySize)
+		}
+		putBuffer(compressed)
+	} else {
+		body = make([]byte, header.BodySize)
+		err = readBody(reader, msg, body)
+	}
 	if err != nil {
-		logrus.Errorf("[Message.Write] write header bytes failed: %v", err)
-		return 0, err
+		logrus.Errorf("[ReadMessage] read body failed: %v", err)
+		if errors.Is(err, ErrMessageTooLarge) {
+			// the decompressed body exceeds the limit, the whole frame was read so the connection is still in sync
+			return msg, err
+		}
+		return nil, err
 	}
-	nWrite += nInc
+	msg.Body = body
 
-	nInc, err = writer.Write(m.Body)
+	return msg, nil
+}
+
+// readBody reads the body of msg into body followed by its checksum trailer if any
+func readBody(reader io.Reader, msg *Message, body []byte) error {
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return err
+	}
+	if !msg.Header.Checksum {
+		return nil
+	}
+	trailer := getBuffer(checksumSize)
+	defer putBuffer(trailer)
+	if _, err := io.ReadFull(reader, *trailer); err != nil {
+		return err
+	}
+
+	return verifyChecksum(reader, *trailer, msg.HeaderLenBytes, msg.RawHeader, body)
+}
+
+// Forward returns a copy of a message read by ReadMessage which can be written to another connection, as the body
+// was decompressed it's sent uncompressed, and the checksum is left to the connection it's written to
+func (m *Message) Forward() *Message {
+	header := proto.Clone(m.Header).(*scrpc.Header)
+	header.Compressed = false
+	header.Checksum = false
+
+	return FromBody(m.Body, header)
+}
+
+// withChecksum returns a copy of the message whose header has checksum set
+func (m *Message) withChecksum() *Message {
+	header := proto.Clone(m.Header).(*scrpc.Header)
+	header.Checksum = true
+
+	return FromBody(m.Body, header)
+}
+
+// features are the optional features of the protocol the peer must support to understand the message
+func (m *Message) features() Feature {
+	var features Feature
+	if m.Header.Compressed {
+		features |= FeatureCompression
+	}
+	if m.Header.Codec != "" && m.Header.Codec != codec.Proto {
+		features |= FeatureCodecs
+	}
+	switch m.Header.MessageType {
+	case scrpc.Header_STREAM_OPEN, scrpc.Header_STREAM_FRAME, scrpc.Header_STREAM_END, scrpc.Header_STREAM_HALF_CLOSE,
+		scrpc.Header_STREAM_WINDOW_UPDATE:
+		features |= FeatureStreams
+	case scrpc.Header_BATCH:
+		features |= FeatureBatch
+	}
+	if m.Header.OneWay {
+		features |= FeatureOneWay
+	}
+	if m.Header.Checksum {
+		features |= FeatureChecksum
+	}
+
+	return features
+}
+
+// Write writes the frame of the message at once, so frames written concurrently never interleave: a *Conn is
+// written by a single vectored write under its write lock, other writers by a single Write of a pooled buffer.
+// A CRC32C trailer is appended if the header has checksum set, or if writer is a *Conn with checksums enabled.
+//
+// The returned count is the number of bytes actually written, even on error. A *Conn which received only a part of
+// the frame is marked broken, so the Manager closes it instead of reusing it. Nothing is written to a *Conn whose
+// peer doesn't support the features of the message, ErrUnsupportedFeature is returned
+func (m *Message) Write(writer io.Writer) (int, error) {
+	conn, isConn := writer.(*Conn)
+	if isConn && !conn.Supports(m.features()) {
+		return 0, fmt.Errorf("%w: message to %s needs features %b, peer supports %b", ErrUnsupportedFeature,
+			m.Header.ReceiverServiceName, m.features(), conn.Protocol().Features)
+	}
+	if isConn && conn.checksumEnabled() && !m.Header.Checksum {
+		m = m.withChecksum()
+	}
+	buffers := net.Buffers{m.HeaderLenBytes, m.RawHeader, m.Body}
+	if m.Header.Checksum {
+		trailer := make([]byte, checksumSize)
+		binary.LittleEndian.PutUint32(trailer, frameChecksum(m.HeaderLenBytes, m.RawHeader, m.Body))
+		buffers = append(buffers, trailer)
+	}
+
+	var (
+		n   int
+		err error
+	)
+	if isConn {
+		n, err = conn.writeBuffers(buffers)
+	} else {
+		n, err = writeBuffered(writer, buffers)
+	}
 	if err != nil {
-		logrus.Errorf("[Message.Write] write body bytes failed: %v", err)
-		return 0, err
+		logrus.Errorf("[Message.Write] write message failed after %d bytes: %v", n, err)
+		return n, err
+	}
+
+	return n, nil
+}
+
+// writeBuffered copies buffers into a pooled buffer and writes it by a single Write
+func writeBuffered(writer io.Writer, buffers net.Buffers) (int, error) {
+	size := 0
+	for _, b := range buffers {
+		size += len(b)
+	}
+	buf := getBuffer(size)
+	defer putBuffer(buf)
+	offset := 0
+	for _, b := range buffers {
+		offset += copy((*buf)[offset:], b)
 	}
-	nWrite += nInc
 
-	return nWrite, nil
+	return writer.Write(*buf)
 }
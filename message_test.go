@@ -0,0 +1,211 @@
+package scrpc
+
+import (
+	"fmt"
+	"github.com/victor-leee/scrpc/github.com/victor-leee/scrpc"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var benchBodySizes = []int{64, 4 << 10, 64 << 10}
+
+// socketPair returns both ends of a unix socket connection
+func socketPair(b testing.TB) (net.Conn, net.Conn) {
+	b.Helper()
+	lis, err := net.Listen("unix", filepath.Join(b.TempDir(), "pair.sock"))
+	if err != nil {
+		b.Fatalf("listen failed: %v", err)
+	}
+	defer lis.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, acceptErr := lis.Accept()
+		if acceptErr != nil {
+			b.Errorf("accept failed: %v", acceptErr)
+		}
+		accepted <- conn
+	}()
+	dialed, err := net.Dial("unix", lis.Addr().String())
+	if err != nil {
+		b.Fatalf("dial failed: %v", err)
+	}
+	peer := <-accepted
+	if peer == nil {
+		b.FailNow()
+	}
+	b.Cleanup(func() {
+		dialed.Close()
+		peer.Close()
+	})
+
+	return dialed, peer
+}
+
+// countingConn counts the reads issued to the connection, each of them is a syscall
+type countingConn struct {
+	net.Conn
+	reads int
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	c.reads++
+
+	return c.Conn.Read(b)
+}
+
+func benchMessage(size int) *Message {
+	return FromBody(make([]byte, size), &scrpc.Header{
+		MessageType:         scrpc.Header_SIDE_CAR_PROXY,
+		SenderServiceName:   "bench-client",
+		ReceiverServiceName: "bench-server",
+		ReceiverMethodName:  "Bench",
+		TraceId:             newTraceID(),
+		SpanId:              newSpanID(),
+	})
+}
+
+// writeFrames writes the frame of msg n times to w
+func writeFrames(b *testing.B, w io.Writer, msg *Message, n int) {
+	frame := append(append(append([]byte{}, msg.HeaderLenBytes...), msg.RawHeader...), msg.Body...)
+	for i := 0; i < n; i++ {
+		if _, err := w.Write(frame); err != nil {
+			b.Errorf("write frame failed: %v", err)
+			return
+		}
+	}
+}
+
+func benchmarkRead(b *testing.B, read func(r io.Reader) (*Message, error), buffered bool) {
+	for _, size := range benchBodySizes {
+		b.Run(fmt.Sprintf("body=%d", size), func(b *testing.B) {
+			writer, reader := socketPair(b)
+			counter := &countingConn{Conn: reader}
+			var r io.Reader = counter
+			if buffered {
+				r = NewConn(counter)
+			}
+			msg := benchMessage(size)
+			go writeFrames(b, writer, msg, b.N)
+
+			b.SetBytes(int64(len(msg.HeaderLenBytes) + len(msg.RawHeader) + size))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := read(r); err != nil {
+					b.Fatalf("read message failed: %v", err)
+				}
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(counter.reads)/float64(b.N), "reads/op")
+		})
+	}
+}
+
+// BenchmarkReadMessage reads messages from a Conn, whose reads are buffered
+func BenchmarkReadMessage(b *testing.B) {
+	benchmarkRead(b, func(r io.Reader) (*Message, error) {
+		return ReadMessage(r)
+	}, true)
+}
+
+// BenchmarkFromReader reads messages by a read function allocating every part from an unbuffered connection,
+// it's the baseline of BenchmarkReadMessage
+func BenchmarkFromReader(b *testing.B) {
+	readFull := func(r io.Reader, size uint64) ([]byte, error) {
+		buf := make([]byte, size)
+		_, err := io.ReadFull(r, buf)
+		return buf, err
+	}
+	benchmarkRead(b, func(r io.Reader) (*Message, error) {
+		return FromReader(r, readFull)
+	}, false)
+}
+
+// writeSyscalls returns the number of write syscalls issued by the process so far, read from /proc/self/io.
+// A net.Conn wrapping the socket can't count them: package net only issues vectored writes on its own connections
+func writeSyscalls() (int, bool) {
+	data, err := os.ReadFile("/proc/self/io")
+	if err != nil {
+		return 0, false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if value := strings.TrimPrefix(line, "syscw: "); value != line {
+			n, parseErr := strconv.Atoi(value)
+			return n, parseErr == nil
+		}
+	}
+
+	return 0, false
+}
+
+// writerOnly hides every method of the socket but Write
+type writerOnly struct {
+	io.Writer
+}
+
+// BenchmarkWrite writes messages over a unix socket: to a Conn by vectored writes, to a plain io.Writer through
+// a pooled buffer, and part by part as the baseline. The write syscalls are reported as writes/op where
+// /proc/self/io exists
+func BenchmarkWrite(b *testing.B) {
+	writes := []struct {
+		name  string
+		write func(netConn net.Conn, msg *Message) func() error
+	}{
+		{name: "conn", write: func(netConn net.Conn, msg *Message) func() error {
+			conn := NewConn(netConn)
+			return func() error {
+				_, err := msg.Write(conn)
+				return err
+			}
+		}},
+		{name: "writer", write: func(netConn net.Conn, msg *Message) func() error {
+			w := writerOnly{netConn}
+			return func() error {
+				_, err := msg.Write(w)
+				return err
+			}
+		}},
+		{name: "parts", write: func(netConn net.Conn, msg *Message) func() error {
+			return func() error {
+				for _, part := range [][]byte{msg.HeaderLenBytes, msg.RawHeader, msg.Body} {
+					if _, err := netConn.Write(part); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+		}},
+	}
+	for _, size := range benchBodySizes {
+		msg := benchMessage(size)
+		for _, w := range writes {
+			b.Run(fmt.Sprintf("%s/body=%d", w.name, size), func(b *testing.B) {
+				writer, reader := socketPair(b)
+				go func() {
+					_, _ = io.Copy(io.Discard, reader)
+				}()
+				write := w.write(writer, msg)
+
+				b.SetBytes(int64(len(msg.HeaderLenBytes) + len(msg.RawHeader) + size))
+				b.ReportAllocs()
+				b.ResetTimer()
+				before, counted := writeSyscalls()
+				for i := 0; i < b.N; i++ {
+					if err := write(); err != nil {
+						b.Fatalf("write message failed: %v", err)
+					}
+				}
+				after, _ := writeSyscalls()
+				b.StopTimer()
+				if counted {
+					b.ReportMetric(float64(after-before)/float64(b.N), "writes/op")
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,142 @@
+// Package metadata carries key-value pairs between services through Header.Extra
+package metadata
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// ReservedPrefix is the key prefix reserved for scrpc itself, user metadata must not use it
+	ReservedPrefix = "scrpc-"
+	// MaxSize is the maximum total size of keys and values of the metadata attached to a request
+	MaxSize = 8 << 10
+)
+
+var (
+	ErrEmptyKey    = errors.New("metadata key is empty")
+	ErrReservedKey = fmt.Errorf("metadata key uses reserved prefix %q", ReservedPrefix)
+	ErrTooLarge    = fmt.Errorf("metadata exceeds %d bytes", MaxSize)
+)
+
+// MD is a mapping from metadata keys to values, keys are case-insensitive and stored in lower case
+type MD map[string]string
+
+// New creates an MD from m
+func New(m map[string]string) MD {
+	md := make(MD, len(m))
+	for k, v := range m {
+		md.Set(k, v)
+	}
+
+	return md
+}
+
+// Pairs creates an MD from key-value pairs, it panics if the number of kv is odd
+func Pairs(kv ...string) MD {
+	if len(kv)%2 == 1 {
+		panic(fmt.Sprintf("metadata: Pairs got an odd number of arguments: %d", len(kv)))
+	}
+	md := make(MD, len(kv)/2)
+	for i := 0; i < len(kv); i += 2 {
+		md.Set(kv[i], kv[i+1])
+	}
+
+	return md
+}
+
+// Get returns the value of key, or an empty string if there is none
+func (md MD) Get(key string) string {
+	return md[strings.ToLower(key)]
+}
+
+// Set sets the value of key
+func (md MD) Set(key, value string) {
+	md[strings.ToLower(key)] = value
+}
+
+// Delete removes key from md
+func (md MD) Delete(key string) {
+	delete(md, strings.ToLower(key))
+}
+
+// Copy returns a copy of md
+func (md MD) Copy() MD {
+	out := make(MD, len(md))
+	for k, v := range md {
+		out[k] = v
+	}
+
+	return out
+}
+
+// Validate checks md can be sent with a request, keys must be non-empty, must not use ReservedPrefix
+// and the total size must not exceed MaxSize
+func (md MD) Validate() error {
+	size := 0
+	for k, v := range md {
+		if k == "" {
+			return ErrEmptyKey
+		}
+		if strings.HasPrefix(k, ReservedPrefix) {
+			return fmt.Errorf("%w: %s", ErrReservedKey, k)
+		}
+		size += len(k) + len(v)
+	}
+	if size > MaxSize {
+		return fmt.Errorf("%w: got %d bytes", ErrTooLarge, size)
+	}
+
+	return nil
+}
+
+type outgoingKey struct{}
+
+type incomingKey struct{}
+
+// NewOutgoingContext returns a copy of ctx carrying md, which is sent with requests made with the returned context
+func NewOutgoingContext(ctx context.Context, md MD) context.Context {
+	return context.WithValue(ctx, outgoingKey{}, md)
+}
+
+// AppendToOutgoingContext returns a copy of ctx whose outgoing metadata is extended with key-value pairs,
+// it panics if the number of kv is odd
+func AppendToOutgoingContext(ctx context.Context, kv ...string) context.Context {
+	md, _ := FromOutgoingContext(ctx)
+	if md == nil {
+		md = MD{}
+	}
+	for k, v := range Pairs(kv...) {
+		md[k] = v
+	}
+
+	return NewOutgoingContext(ctx, md)
+}
+
+// FromOutgoingContext returns a copy of the outgoing metadata carried by ctx
+func FromOutgoingContext(ctx context.Context) (MD, bool) {
+	md, ok := ctx.Value(outgoingKey{}).(MD)
+	if !ok {
+		return nil, false
+	}
+
+	return md.Copy(), true
+}
+
+// NewIncomingContext returns a copy of ctx carrying md as the metadata received with a request,
+// it's called by servers and is rarely needed otherwise
+func NewIncomingContext(ctx context.Context, md MD) context.Context {
+	return context.WithValue(ctx, incomingKey{}, md)
+}
+
+// FromIncomingContext returns a copy of the metadata received with the request being served
+func FromIncomingContext(ctx context.Context) (MD, bool) {
+	md, ok := ctx.Value(incomingKey{}).(MD)
+	if !ok {
+		return nil, false
+	}
+
+	return md.Copy(), true
+}
@@ -0,0 +1,60 @@
+package metadata
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidateRejectsReservedPrefix(t *testing.T) {
+	for _, key := range []string{"scrpc-trace", "SCRPC-Trace"} {
+		// keys are stored in lower case, so the prefix is reserved whatever its case
+		if err := Pairs(key, "v").Validate(); !errors.Is(err, ErrReservedKey) {
+			t.Errorf("key %q got %v, expected ErrReservedKey", key, err)
+		}
+	}
+	if err := Pairs("x-scrpc-trace", "v").Validate(); err != nil {
+		t.Errorf("got %v for a key containing the prefix elsewhere", err)
+	}
+	if err := Pairs("", "v").Validate(); !errors.Is(err, ErrEmptyKey) {
+		t.Errorf("got %v for an empty key, expected ErrEmptyKey", err)
+	}
+}
+
+func TestValidateLimitsSize(t *testing.T) {
+	// the size counts both the keys and the values
+	key := "k"
+	md := Pairs(key, strings.Repeat("v", MaxSize-len(key)))
+	if err := md.Validate(); err != nil {
+		t.Fatalf("got %v for metadata of exactly MaxSize bytes", err)
+	}
+	md.Set("a", "")
+	if err := md.Validate(); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("got %v for metadata of MaxSize+1 bytes, expected ErrTooLarge", err)
+	}
+}
+
+func TestPairsPanicsOnOddArguments(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Pairs didn't panic on an odd number of arguments")
+		}
+	}()
+	Pairs("key", "value", "orphan")
+}
+
+func TestAppendToOutgoingContext(t *testing.T) {
+	ctx := NewOutgoingContext(context.Background(), Pairs("A", "1"))
+	ctx = AppendToOutgoingContext(ctx, "b", "2")
+
+	md, ok := FromOutgoingContext(ctx)
+	if !ok || md.Get("a") != "1" || md.Get("B") != "2" {
+		t.Fatalf("got %v, %t, expected a=1 and b=2", md, ok)
+	}
+	// the returned metadata is a copy
+	md.Set("a", "changed")
+	if again, _ := FromOutgoingContext(ctx); again.Get("a") != "1" {
+		t.Errorf("modifying the returned metadata changed the context to %v", again)
+	}
+}
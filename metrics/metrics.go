@@ -0,0 +1,167 @@
+// Package metrics provides Prometheus metrics for scrpc clients, servers and connection pools
+package metrics
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/victor-leee/scrpc"
+	scrpcpb "github.com/victor-leee/scrpc/github.com/victor-leee/scrpc"
+	"google.golang.org/protobuf/proto"
+	"time"
+)
+
+const namespace = "scrpc"
+
+var (
+	requestLabels  = []string{"sender_service", "receiver_service", "method", "message_type", "code"}
+	inFlightLabels = []string{"sender_service", "receiver_service", "method", "message_type"}
+)
+
+type options struct {
+	buckets []float64
+}
+
+type Opt func(opts *options)
+
+// WithBuckets sets the buckets of the latency histograms, prometheus.DefBuckets is used by default
+func WithBuckets(buckets []float64) Opt {
+	return func(opts *options) {
+		opts.buckets = buckets
+	}
+}
+
+// sideMetrics are the request metrics of one side (client or server)
+type sideMetrics struct {
+	requests *prometheus.CounterVec
+	latency  *prometheus.HistogramVec
+	inFlight *prometheus.GaugeVec
+}
+
+func newSideMetrics(side string, buckets []float64) *sideMetrics {
+	return &sideMetrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: side,
+			Name:      "requests_total",
+			Help:      "Total number of finished requests.",
+		}, requestLabels),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: side,
+			Name:      "request_duration_seconds",
+			Help:      "Latency of finished requests in seconds.",
+			Buckets:   buckets,
+		}, requestLabels),
+		inFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: side,
+			Name:      "requests_in_flight",
+			Help:      "Number of requests being processed.",
+		}, inFlightLabels),
+	}
+}
+
+func (s *sideMetrics) register(reg prometheus.Registerer) error {
+	for _, c := range []prometheus.Collector{s.requests, s.latency, s.inFlight} {
+		if err := reg.Register(c); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// observe starts tracking a request described by header, the returned function must be called with the result
+func (s *sideMetrics) observe(header *scrpcpb.Header) func(err error) {
+	labels := []string{header.SenderServiceName, header.ReceiverServiceName, header.ReceiverMethodName,
+		header.MessageType.String()}
+	inFlight := s.inFlight.WithLabelValues(labels...)
+	inFlight.Inc()
+	start := time.Now()
+
+	return func(err error) {
+		inFlight.Dec()
+		resultLabels := append(labels, string(scrpc.StatusCodeOf(err)))
+		s.requests.WithLabelValues(resultLabels...).Inc()
+		s.latency.WithLabelValues(resultLabels...).Observe(time.Since(start).Seconds())
+	}
+}
+
+// Metrics holds the collectors of scrpc traffic registered on a prometheus.Registerer
+type Metrics struct {
+	reg    prometheus.Registerer
+	client *sideMetrics
+	server *sideMetrics
+}
+
+// New creates the scrpc collectors and registers them on reg
+func New(reg prometheus.Registerer, opts ...Opt) (*Metrics, error) {
+	o := &options{
+		buckets: prometheus.DefBuckets,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	m := &Metrics{
+		reg:    reg,
+		client: newSideMetrics("client", o.buckets),
+		server: newSideMetrics("server", o.buckets),
+	}
+	if err := m.client.register(reg); err != nil {
+		return nil, err
+	}
+	if err := m.server.register(reg); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// ClientInterceptor returns a scrpc.ClientInterceptor recording the client side request metrics
+func (m *Metrics) ClientInterceptor() scrpc.ClientInterceptor {
+	return func(ctx context.Context, header *scrpcpb.Header, req, resp proto.Message, invoker scrpc.Invoker) error {
+		done := m.client.observe(header)
+		err := invoker(ctx, header, req, resp)
+		done(err)
+
+		return err
+	}
+}
+
+// ServerInterceptor returns a scrpc.ServerInterceptor recording the server side request metrics
+func (m *Metrics) ServerInterceptor() scrpc.ServerInterceptor {
+	return func(ctx context.Context, header *scrpcpb.Header, body []byte, handler scrpc.ContextHandler) (proto.Message, error) {
+		done := m.server.observe(header)
+		resp, err := handler(ctx, body)
+		done(err)
+
+		return resp, err
+	}
+}
+
+// ClientStreamInterceptor returns a scrpc.StreamInterceptor recording the client side metrics of streams and batches
+func (m *Metrics) ClientStreamInterceptor() scrpc.StreamInterceptor {
+	return func(_ context.Context, header *scrpcpb.Header) func(err error) {
+		return m.client.observe(header)
+	}
+}
+
+// ServerStreamInterceptor returns a scrpc.StreamInterceptor recording the server side metrics of streams,
+// the items of batches are recorded by ServerInterceptor
+func (m *Metrics) ServerStreamInterceptor() scrpc.StreamInterceptor {
+	return func(_ context.Context, header *scrpcpb.Header) func(err error) {
+		return m.server.observe(header)
+	}
+}
+
+// PoolStatsSource is implemented by scrpc.Client and scrpc.Server
+type PoolStatsSource interface {
+	PoolStats() map[string]scrpc.PoolStats
+}
+
+// RegisterPools registers gauges of the connection pools of src, owner distinguishes the pools of
+// different clients and servers and is attached to the gauges as a label
+func (m *Metrics) RegisterPools(owner string, src PoolStatsSource) error {
+	return m.reg.Register(newPoolCollector(owner, src))
+}
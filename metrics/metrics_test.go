@@ -0,0 +1,214 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/victor-leee/scrpc"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testService = "greeter"
+
+// newTestPair returns a client and a server of testService, both instrumented by m and talking directly over
+// a unix socket in TransportRemote mode
+func newTestPair(t *testing.T, m *Metrics) scrpc.Client {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "greeter.sock")
+	transport := &scrpc.TransportConfig{
+		Protocol: "unix",
+		Path:     path,
+		PoolCfg:  &scrpc.PoolConfig{MaxSize: 2},
+	}
+
+	server, err := scrpc.NewServer(testService,
+		scrpc.WithServerConfig(&scrpc.Config{Mode: scrpc.TransportRemote, RemoteTransportConfig: transport}),
+		scrpc.WithServerInterceptors(m.ServerInterceptor()),
+		scrpc.WithServerStreamInterceptors(m.ServerStreamInterceptor()))
+	if err != nil {
+		t.Fatalf("create server failed: %v", err)
+	}
+	server.RegisterHandler("Hello", func(b []byte) (proto.Message, error) {
+		return wrapperspb.String("hello"), nil
+	})
+	server.RegisterHandler("Fail", func([]byte) (proto.Message, error) {
+		return nil, errors.New("handler failed")
+	})
+	server.RegisterStreamHandler("Count", func(b []byte, stream scrpc.ServerStream) error {
+		for i := int32(1); i <= 3; i++ {
+			if sendErr := stream.Send(wrapperspb.Int32(i)); sendErr != nil {
+				return sendErr
+			}
+		}
+		return nil
+	})
+	if err = server.Start(); err != nil {
+		t.Fatalf("start server failed: %v", err)
+	}
+
+	client, err := scrpc.NewClient(scrpc.WithConfig(&scrpc.Config{
+		Mode:                  scrpc.TransportRemote,
+		RemoteTransportConfig: &scrpc.TransportConfig{Protocol: "unix", PoolCfg: &scrpc.PoolConfig{MaxSize: 2}},
+		Peers:                 map[string]string{testService: path},
+	}), scrpc.WithClientInterceptors(m.ClientInterceptor()),
+		scrpc.WithClientStreamInterceptors(m.ClientStreamInterceptor()))
+	if err != nil {
+		t.Fatalf("create client failed: %v", err)
+	}
+	t.Cleanup(func() {
+		if closeErr := client.Close(); closeErr != nil {
+			t.Errorf("close client failed: %v", closeErr)
+		}
+		if closeErr := server.Close(); closeErr != nil {
+			t.Errorf("close server failed: %v", closeErr)
+		}
+	})
+
+	return client
+}
+
+func request(method string, req, resp proto.Message) *scrpc.RequestContext {
+	return &scrpc.RequestContext{
+		Ctx:           context.Background(),
+		Req:           req,
+		ReqService:    testService,
+		ReqMethod:     method,
+		SenderService: "caller",
+		Resp:          resp,
+	}
+}
+
+// sampleCount returns the number of observations of the histogram name whose labels are labels
+func sampleCount(t *testing.T, reg *prometheus.Registry, name string, labels prometheus.Labels) uint64 {
+	t.Helper()
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			if hasLabels(metric, labels) {
+				return metric.GetHistogram().GetSampleCount()
+			}
+		}
+	}
+
+	return 0
+}
+
+func hasLabels(metric *dto.Metric, labels prometheus.Labels) bool {
+	if len(metric.GetLabel()) != len(labels) {
+		return false
+	}
+	for _, pair := range metric.GetLabel() {
+		if labels[pair.GetName()] != pair.GetValue() {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestInterceptorsRecordRequests(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m, err := New(reg)
+	if err != nil {
+		t.Fatalf("create metrics failed: %v", err)
+	}
+	client := newTestPair(t, m)
+
+	if err = client.UnaryRPCRequest(request("Hello", wrapperspb.String(""), &wrapperspb.StringValue{})); err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	if err = client.UnaryRPCRequest(request("Fail", wrapperspb.String(""), &wrapperspb.StringValue{})); !errors.Is(err, scrpc.ErrRemote) {
+		t.Fatalf("got %v, expected ErrRemote", err)
+	}
+	stream, err := client.ServerStreamRequest(request("Count", wrapperspb.Int32(0), nil))
+	if err != nil {
+		t.Fatalf("open stream failed: %v", err)
+	}
+	for err == nil {
+		err = stream.Recv(&wrapperspb.Int32Value{})
+	}
+	if !errors.Is(err, io.EOF) {
+		t.Fatalf("stream failed: %v", err)
+	}
+
+	// the server records a request before answering it, so both sides are recorded by now
+	tests := []struct {
+		method string
+		// the code of the server is the one of the handler error, the client sees it as a remote error
+		clientCode, serverCode scrpc.StatusCode
+	}{
+		{method: "Hello", clientCode: scrpc.StatusOK, serverCode: scrpc.StatusOK},
+		{method: "Fail", clientCode: scrpc.StatusRemote, serverCode: scrpc.StatusUnknown},
+		{method: "Count", clientCode: scrpc.StatusOK, serverCode: scrpc.StatusOK},
+	}
+	for _, tt := range tests {
+		for subsystem, code := range map[string]scrpc.StatusCode{"client": tt.clientCode, "server": tt.serverCode} {
+			labels := prometheus.Labels{
+				"sender_service":   "caller",
+				"receiver_service": testService,
+				"method":           tt.method,
+				"message_type":     "SIDE_CAR_PROXY",
+				"code":             string(code),
+			}
+			side := m.client
+			if subsystem == "server" {
+				side = m.server
+			}
+			if n := testutil.ToFloat64(side.requests.With(labels)); n != 1 {
+				t.Errorf("got %v %s requests labelled %v, expected 1", n, subsystem, labels)
+			}
+			name := prometheus.BuildFQName(namespace, subsystem, "request_duration_seconds")
+			if n := sampleCount(t, reg, name, labels); n != 1 {
+				t.Errorf("got %d observations of %s labelled %v, expected 1", n, name, labels)
+			}
+			delete(labels, "code")
+			if n := testutil.ToFloat64(side.inFlight.With(labels)); n != 0 {
+				t.Errorf("got %v %s requests in flight labelled %v, expected 0", n, subsystem, labels)
+			}
+		}
+	}
+}
+
+type fakePools map[string]scrpc.PoolStats
+
+func (f fakePools) PoolStats() map[string]scrpc.PoolStats {
+	return f
+}
+
+func TestRegisterPools(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m, err := New(reg)
+	if err != nil {
+		t.Fatalf("create metrics failed: %v", err)
+	}
+	if err = m.RegisterPools("client", fakePools{"/tmp/sc.sock": {Idle: 2, InUse: 1, MaxSize: 5}}); err != nil {
+		t.Fatalf("register pools failed: %v", err)
+	}
+
+	expected := `
+# HELP scrpc_pool_connections Number of connections held by the pool by state.
+# TYPE scrpc_pool_connections gauge
+scrpc_pool_connections{owner="client",pool="/tmp/sc.sock",state="idle"} 2
+scrpc_pool_connections{owner="client",pool="/tmp/sc.sock",state="in_use"} 1
+# HELP scrpc_pool_max_connections Maximum number of connections allowed by the pool.
+# TYPE scrpc_pool_max_connections gauge
+scrpc_pool_max_connections{owner="client",pool="/tmp/sc.sock"} 5
+`
+	err = testutil.GatherAndCompare(reg, strings.NewReader(expected), "scrpc_pool_connections", "scrpc_pool_max_connections")
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,39 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// poolCollector reports the pool stats of a PoolStatsSource at collection time
+type poolCollector struct {
+	owner       string
+	src         PoolStatsSource
+	connections *prometheus.Desc
+	maxSize     *prometheus.Desc
+}
+
+func newPoolCollector(owner string, src PoolStatsSource) *poolCollector {
+	constLabels := prometheus.Labels{"owner": owner}
+
+	return &poolCollector{
+		owner: owner,
+		src:   src,
+		connections: prometheus.NewDesc(prometheus.BuildFQName(namespace, "pool", "connections"),
+			"Number of connections held by the pool by state.", []string{"pool", "state"}, constLabels),
+		maxSize: prometheus.NewDesc(prometheus.BuildFQName(namespace, "pool", "max_connections"),
+			"Maximum number of connections allowed by the pool.", []string{"pool"}, constLabels),
+	}
+}
+
+func (c *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.connections
+	ch <- c.maxSize
+}
+
+func (c *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	for pool, stats := range c.src.PoolStats() {
+		ch <- prometheus.MustNewConstMetric(c.connections, prometheus.GaugeValue, float64(stats.Idle), pool, "idle")
+		ch <- prometheus.MustNewConstMetric(c.connections, prometheus.GaugeValue, float64(stats.InUse), pool, "in_use")
+		ch <- prometheus.MustNewConstMetric(c.maxSize, prometheus.GaugeValue, float64(stats.MaxSize), pool)
+	}
+}
@@ -0,0 +1,49 @@
+// Package otel provides OpenTelemetry tracing instrumentation for scrpc clients and servers
+package otel
+
+import (
+	otelapi "go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName is the name of the tracer created from the TracerProvider
+const instrumentationName = "github.com/victor-leee/scrpc/otel"
+
+type config struct {
+	tracerProvider trace.TracerProvider
+	propagator     propagation.TextMapPropagator
+}
+
+type Opt func(cfg *config)
+
+// WithTracerProvider sets the TracerProvider creating spans, the global one is used by default
+func WithTracerProvider(tp trace.TracerProvider) Opt {
+	return func(cfg *config) {
+		cfg.tracerProvider = tp
+	}
+}
+
+// WithPropagator sets the propagator used to carry span context through Header.Extra,
+// the W3C trace context propagator is used by default
+func WithPropagator(p propagation.TextMapPropagator) Opt {
+	return func(cfg *config) {
+		cfg.propagator = p
+	}
+}
+
+func newConfig(opts []Opt) *config {
+	cfg := &config{
+		tracerProvider: otelapi.GetTracerProvider(),
+		propagator:     propagation.TraceContext{},
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	return cfg
+}
+
+func (c *config) tracer() trace.Tracer {
+	return c.tracerProvider.Tracer(instrumentationName)
+}
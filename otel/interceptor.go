@@ -0,0 +1,117 @@
+package otel
+
+import (
+	"context"
+	"github.com/victor-leee/scrpc"
+	scrpcpb "github.com/victor-leee/scrpc/github.com/victor-leee/scrpc"
+	"github.com/victor-leee/scrpc/metadata"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/protobuf/proto"
+	"strings"
+)
+
+const (
+	statusCodeKey    = attribute.Key("rpc.scrpc.status_code")
+	senderServiceKey = attribute.Key("rpc.scrpc.sender_service")
+	requestSizeKey   = attribute.Key("rpc.scrpc.request.size")
+	responseSizeKey  = attribute.Key("rpc.scrpc.response.size")
+)
+
+// extraCarrier carries the fields of the propagator in Header.Extra under metadata.ReservedPrefix, so they
+// travel with the request but aren't part of the metadata seen by the handler
+type extraCarrier map[string]string
+
+func (c extraCarrier) Get(key string) string {
+	return c[metadata.ReservedPrefix+key]
+}
+
+func (c extraCarrier) Set(key, value string) {
+	c[metadata.ReservedPrefix+key] = value
+}
+
+func (c extraCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		if strings.HasPrefix(k, metadata.ReservedPrefix) {
+			keys = append(keys, strings.TrimPrefix(k, metadata.ReservedPrefix))
+		}
+	}
+
+	return keys
+}
+
+// ClientInterceptor returns a scrpc.ClientInterceptor creating a client span for every request and injecting
+// the span context into Header.Extra, e.g. the W3C traceparent as scrpc-traceparent
+func ClientInterceptor(opts ...Opt) scrpc.ClientInterceptor {
+	cfg := newConfig(opts)
+	tracer := cfg.tracer()
+
+	return func(ctx context.Context, header *scrpcpb.Header, req, resp proto.Message, invoker scrpc.Invoker) error {
+		ctx, span := tracer.Start(ctx, spanName(header),
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(attributes(header)...),
+			trace.WithAttributes(requestSizeKey.Int(proto.Size(req))))
+		defer span.End()
+
+		if header.Extra == nil {
+			header.Extra = make(map[string]string)
+		}
+		cfg.propagator.Inject(ctx, extraCarrier(header.Extra))
+
+		err := invoker(ctx, header, req, resp)
+		if err == nil {
+			span.SetAttributes(responseSizeKey.Int(proto.Size(resp)))
+		}
+		setStatus(span, err)
+
+		return err
+	}
+}
+
+// ServerInterceptor returns a scrpc.ServerInterceptor extracting the span context from Header.Extra and creating
+// a server span for every request, the span is carried by the context passed to the handler
+func ServerInterceptor(opts ...Opt) scrpc.ServerInterceptor {
+	cfg := newConfig(opts)
+	tracer := cfg.tracer()
+
+	return func(ctx context.Context, header *scrpcpb.Header, body []byte, handler scrpc.ContextHandler) (proto.Message, error) {
+		ctx = cfg.propagator.Extract(ctx, extraCarrier(header.Extra))
+		ctx, span := tracer.Start(ctx, spanName(header),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(attributes(header)...),
+			trace.WithAttributes(requestSizeKey.Int(len(body))))
+		defer span.End()
+
+		resp, err := handler(ctx, body)
+		if err == nil && resp != nil {
+			span.SetAttributes(responseSizeKey.Int(proto.Size(resp)))
+		}
+		setStatus(span, err)
+
+		return resp, err
+	}
+}
+
+func spanName(header *scrpcpb.Header) string {
+	return header.ReceiverServiceName + "/" + header.ReceiverMethodName
+}
+
+func attributes(header *scrpcpb.Header) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		semconv.RPCSystemKey.String("scrpc"),
+		semconv.RPCServiceKey.String(header.ReceiverServiceName),
+		semconv.RPCMethodKey.String(header.ReceiverMethodName),
+		senderServiceKey.String(header.SenderServiceName),
+	}
+}
+
+func setStatus(span trace.Span, err error) {
+	span.SetAttributes(statusCodeKey.String(string(scrpc.StatusCodeOf(err))))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
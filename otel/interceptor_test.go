@@ -0,0 +1,148 @@
+package otel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/victor-leee/scrpc"
+	scrpcpb "github.com/victor-leee/scrpc/github.com/victor-leee/scrpc"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/protobuf/proto"
+	"testing"
+)
+
+func newTracerProvider() (*sdktrace.TracerProvider, *tracetest.InMemoryExporter) {
+	exporter := tracetest.NewInMemoryExporter()
+
+	return sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)), exporter
+}
+
+func attributeValue(span tracetest.SpanStub, key attribute.Key) (attribute.Value, bool) {
+	for _, kv := range span.Attributes {
+		if kv.Key == key {
+			return kv.Value, true
+		}
+	}
+
+	return attribute.Value{}, false
+}
+
+func TestInterceptorsPropagateSpan(t *testing.T) {
+	tp, exporter := newTracerProvider()
+	client := ClientInterceptor(WithTracerProvider(tp))
+	server := ServerInterceptor(WithTracerProvider(tp))
+
+	req := &scrpcpb.Header{ReceiverServiceName: "request"}
+	resp := &scrpcpb.Header{}
+	answer := &scrpcpb.Header{ReceiverServiceName: "response body"}
+	var serverCtx trace.SpanContext
+	// the invoker plays the transport: the server reads the header written by the client interceptor
+	invoker := func(ctx context.Context, header *scrpcpb.Header, req, resp proto.Message) error {
+		// the field is reserved for scrpc, so it isn't part of the metadata of the handler
+		if _, ok := header.Extra["scrpc-traceparent"]; !ok {
+			t.Fatalf("scrpc-traceparent not injected into Header.Extra: %v", header.Extra)
+		}
+		if _, ok := header.Extra["traceparent"]; ok {
+			t.Fatalf("traceparent injected without the reserved prefix: %v", header.Extra)
+		}
+		body, err := proto.Marshal(req)
+		if err != nil {
+			return err
+		}
+		served, err := server(context.Background(), header, body, func(ctx context.Context, _ []byte) (proto.Message, error) {
+			serverCtx = trace.SpanContextFromContext(ctx)
+			return answer, nil
+		})
+		if err != nil {
+			return err
+		}
+		proto.Merge(resp, served)
+		return nil
+	}
+	header := &scrpcpb.Header{
+		ReceiverServiceName: "greeter",
+		ReceiverMethodName:  "Hello",
+		SenderServiceName:   "caller",
+	}
+	if err := client(context.Background(), header, req, resp, invoker); err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, expected 2", len(spans))
+	}
+	// the server span ends first
+	serverSpan, clientSpan := spans[0], spans[1]
+	for _, span := range spans {
+		if span.Name != "greeter/Hello" {
+			t.Errorf("span name %q, expected greeter/Hello", span.Name)
+		}
+		if v, _ := attributeValue(span, statusCodeKey); v.AsString() != string(scrpc.StatusOK) {
+			t.Errorf("%s span status code %q, expected %s", span.SpanKind, v.AsString(), scrpc.StatusOK)
+		}
+		if span.Status.Code == codes.Error {
+			t.Errorf("%s span has error status", span.SpanKind)
+		}
+	}
+	if clientSpan.SpanKind != trace.SpanKindClient || serverSpan.SpanKind != trace.SpanKindServer {
+		t.Fatalf("span kinds %s and %s, expected client and server", clientSpan.SpanKind, serverSpan.SpanKind)
+	}
+	if serverSpan.Parent.SpanID() != clientSpan.SpanContext.SpanID() ||
+		serverSpan.SpanContext.TraceID() != clientSpan.SpanContext.TraceID() {
+		t.Errorf("server span isn't a child of the client span")
+	}
+	if !serverCtx.Equal(serverSpan.SpanContext) {
+		t.Errorf("handler context doesn't carry the server span")
+	}
+
+	for _, size := range []struct {
+		span     tracetest.SpanStub
+		key      attribute.Key
+		expected int
+	}{
+		{clientSpan, requestSizeKey, proto.Size(req)},
+		{clientSpan, responseSizeKey, proto.Size(answer)},
+		{serverSpan, requestSizeKey, proto.Size(req)},
+		{serverSpan, responseSizeKey, proto.Size(answer)},
+	} {
+		v, ok := attributeValue(size.span, size.key)
+		if !ok || v.AsInt64() != int64(size.expected) {
+			t.Errorf("%s span %s = %v, expected %d", size.span.SpanKind, size.key, v.AsInt64(), size.expected)
+		}
+	}
+}
+
+func TestClientInterceptorRecordsError(t *testing.T) {
+	tp, exporter := newTracerProvider()
+	client := ClientInterceptor(WithTracerProvider(tp))
+
+	remoteErr := fmt.Errorf("%w: boom", scrpc.ErrRemote)
+	err := client(context.Background(), &scrpcpb.Header{ReceiverServiceName: "greeter", ReceiverMethodName: "Hello"},
+		&scrpcpb.Header{}, &scrpcpb.Header{},
+		func(context.Context, *scrpcpb.Header, proto.Message, proto.Message) error {
+			return remoteErr
+		})
+	if !errors.Is(err, scrpc.ErrRemote) {
+		t.Fatalf("got %v, expected the error of the invoker", err)
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans, expected 1", len(spans))
+	}
+	span := spans[0]
+	if v, _ := attributeValue(span, statusCodeKey); v.AsString() != string(scrpc.StatusRemote) {
+		t.Errorf("status code %q, expected %s", v.AsString(), scrpc.StatusRemote)
+	}
+	if span.Status.Code != codes.Error || span.Status.Description != remoteErr.Error() {
+		t.Errorf("span status %v, expected error %q", span.Status, remoteErr)
+	}
+	if _, ok := attributeValue(span, responseSizeKey); ok {
+		t.Errorf("failed request has a response size")
+	}
+}
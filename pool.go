@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/sirupsen/logrus"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -15,12 +16,35 @@ type ConnPool interface {
 	Get() (*Conn, error)
 	Put(conn *Conn) error
 	Close() error
+	// Stats returns a snapshot of the connections held by the pool
+	Stats() PoolStats
+	// Resize changes the maximum number of connections of the pool
+	Resize(maxSize int) error
 }
 
+var errPoolClosed = errors.New("pool is closed")
+
+// PoolStats describes the connections of a ConnPool at some point
+type PoolStats struct {
+	// Idle is the number of connections waiting in the pool
+	Idle int
+	// InUse is the number of connections taken out of the pool and not put back yet
+	InUse int
+	// MaxSize is the maximum number of connections the pool allows, 0 if it's unknown
+	MaxSize int
+}
+
+// pool creates connections on demand up to maxConn, Get waits for a connection to be put back once the limit
+// is reached. The limit can be changed at any time by Resize
 type pool struct {
-	opts       *options
-	connChan   chan *Conn
-	ticketChan chan struct{}
+	opts *options
+
+	mux  sync.Mutex
+	cond *sync.Cond
+	idle []*Conn
+	// open is the number of connections created and not discarded yet, including the ones being created
+	open   int
+	closed bool
 }
 
 type options struct {
@@ -35,6 +59,7 @@ func NewPool(opts ...PoolOpt) (ConnPool, error) {
 	p := &pool{
 		opts: &options{},
 	}
+	p.cond = sync.NewCond(&p.mux)
 	for _, opt := range opts {
 		opt(p)
 	}
@@ -46,31 +71,78 @@ func NewPool(opts ...PoolOpt) (ConnPool, error) {
 }
 
 func (p *pool) Get() (*Conn, error) {
-	select {
-	case conn := <-p.connChan:
-		return conn, nil
-	default:
-		// try to create one, if failed block wait the channel
-		if !p.requestTicket() {
-			return <-p.connChan, nil
+	p.mux.Lock()
+	for {
+		if p.closed {
+			p.mux.Unlock()
+			return nil, errPoolClosed
+		}
+		if n := len(p.idle); n > 0 {
+			conn := p.idle[n-1]
+			p.idle = p.idle[:n-1]
+			p.mux.Unlock()
+			return conn, nil
 		}
+		if p.open < p.opts.maxConn {
+			break
+		}
+		// wait for a connection to be put back or discarded
+		p.cond.Wait()
+	}
+	p.open++
+	p.mux.Unlock()
 
-		return p.opts.factory()
+	conn, err := p.opts.factory()
+	if err != nil {
+		p.discard()
+		return nil, err
 	}
+
+	return conn, nil
 }
 
 func (p *pool) Put(conn *Conn) error {
 	// before we put back the connection to the pool, we should check its status
-	if p.isBrokenConn(conn) {
-		// for each broken connection we allow one more creation
-		p.createTicket()
+	if conn.Broken() || p.isBrokenConn(conn) {
+		closeBrokenConn(conn)
+		// the connection leaves room for a new one
+		p.discard()
 		return errors.New("connection is broken")
 	}
-	p.connChan <- conn
+
+	p.mux.Lock()
+	if p.closed || p.open > p.opts.maxConn {
+		// the pool is closed or shrunk by Resize
+		p.open--
+		p.mux.Unlock()
+		p.cond.Signal()
+		if err := conn.Close(); err != nil {
+			logrus.Warnf("[pool.Put] close surplus connection failed: %v", err)
+		}
+		return nil
+	}
+	p.idle = append(p.idle, conn)
+	p.mux.Unlock()
+	p.cond.Signal()
 
 	return nil
 }
 
+// discard forgets a connection which won't be put back
+func (p *pool) discard() {
+	p.mux.Lock()
+	p.open--
+	p.mux.Unlock()
+	p.cond.Signal()
+}
+
+// closeBrokenConn closes conn which is discarded by a pool, it may already be closed
+func closeBrokenConn(conn *Conn) {
+	if err := conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		logrus.Warnf("close broken connection failed: %v", err)
+	}
+}
+
 func (p *pool) isBrokenConn(conn *Conn) (broken bool) {
 	defer func() {
 		// set read deadline "never"
@@ -102,9 +174,61 @@ func (p *pool) isReadTimeoutErr(err error) bool {
 	return false
 }
 
+func (p *pool) Stats() PoolStats {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	return PoolStats{
+		Idle:    len(p.idle),
+		InUse:   p.open - len(p.idle),
+		MaxSize: p.opts.maxConn,
+	}
+}
+
+// Resize changes the maximum number of connections, surplus connections are closed as soon as they are idle
+func (p *pool) Resize(maxSize int) error {
+	if maxSize <= 0 {
+		return fmt.Errorf("pool size must be positive, got %d", maxSize)
+	}
+
+	p.mux.Lock()
+	p.opts.maxConn = maxSize
+	var surplus []*Conn
+	for p.open > maxSize && len(p.idle) > 0 {
+		surplus = append(surplus, p.idle[len(p.idle)-1])
+		p.idle = p.idle[:len(p.idle)-1]
+		p.open--
+	}
+	p.mux.Unlock()
+	// waiters may create connections if the pool grew
+	p.cond.Broadcast()
+
+	for _, conn := range surplus {
+		if err := conn.Close(); err != nil {
+			logrus.Warnf("[pool.Resize] close surplus connection failed: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// Close closes the idle connections, the ones in use are closed when they are put back
 func (p *pool) Close() error {
-	// TODO impl
-	panic("todo")
+	p.mux.Lock()
+	p.closed = true
+	idle := p.idle
+	p.idle = nil
+	p.open -= len(idle)
+	p.mux.Unlock()
+	p.cond.Broadcast()
+
+	for _, conn := range idle {
+		if err := conn.Close(); err != nil {
+			logrus.Warnf("[pool.Close] close connection failed: %v", err)
+		}
+	}
+
+	return nil
 }
 
 func (p *pool) init() error {
@@ -118,44 +242,19 @@ func (p *pool) init() error {
 		return errors.New("a pool should be allowed to contain resources, otherwise it's unnecessary to create one")
 	}
 
-	p.ticketChan = make(chan struct{}, p.opts.maxConn)
-	for i := 0; i < p.opts.maxConn; i++ {
-		p.createTicket()
-	}
-
-	p.connChan = make(chan *Conn, p.opts.maxConn)
 	for i := 0; i < p.opts.initConn; i++ {
-		if !p.requestTicket() {
-			return errors.New("request ticket to create connection failed")
-		}
 		conn, err := p.opts.factory()
 		if err != nil {
 			// failed ? no worry, retry later
-			p.createTicket()
 			continue
 		}
-		p.connChan <- conn
+		p.idle = append(p.idle, conn)
+		p.open++
 	}
 
 	return nil
 }
 
-func (p *pool) requestTicket() (success bool) {
-	select {
-	case <-p.ticketChan:
-		return true
-	default:
-		return false
-	}
-}
-
-func (p *pool) createTicket() {
-	select {
-	case p.ticketChan <- struct{}{}:
-	default:
-	}
-}
-
 func WithFactory(f func() (*Conn, error)) PoolOpt {
 	return func(pool *pool) {
 		pool.opts.factory = f
@@ -178,6 +277,9 @@ const defaultPoolSize = 50
 
 type getFromPutPool struct {
 	connChan chan *Conn
+	// mux guards closed, puts and Close hold it so that nothing is sent once connChan is closed
+	mux    sync.RWMutex
+	closed bool
 }
 
 func NewGetFromPutPool() (ConnPool, error) {
@@ -187,15 +289,55 @@ func NewGetFromPutPool() (ConnPool, error) {
 }
 
 func (g *getFromPutPool) Get() (*Conn, error) {
-	return <-g.connChan, nil
+	conn, ok := <-g.connChan
+	if !ok {
+		return nil, errPoolClosed
+	}
+
+	return conn, nil
 }
 
 func (g *getFromPutPool) Put(conn *Conn) error {
-	g.connChan <- conn
+	if conn.Broken() {
+		closeBrokenConn(conn)
+		return errors.New("connection is broken")
+	}
+	g.mux.RLock()
+	defer g.mux.RUnlock()
+	if !g.closed {
+		select {
+		case g.connChan <- conn:
+			return nil
+		default:
+		}
+	}
+	// the pool is closed or full
+	if err := conn.Close(); err != nil {
+		logrus.Warnf("[getFromPutPool.Put] close surplus connection failed: %v", err)
+	}
+
 	return nil
 }
 
+func (g *getFromPutPool) Stats() PoolStats {
+	return PoolStats{
+		Idle:    len(g.connChan),
+		MaxSize: cap(g.connChan),
+	}
+}
+
+// Resize isn't supported, the size of the pool is the number of connections put by the caller
+func (g *getFromPutPool) Resize(_ int) error {
+	return errors.New("getFromPutPool can't be resized")
+}
+
 func (g *getFromPutPool) Close() error {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	if g.closed {
+		return nil
+	}
+	g.closed = true
 	close(g.connChan)
 	for conn := range g.connChan {
 		conn.Close()
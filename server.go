@@ -1,58 +1,232 @@
 package scrpc
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"github.com/sirupsen/logrus"
+	"github.com/victor-leee/scrpc/codec"
 	"github.com/victor-leee/scrpc/github.com/victor-leee/scrpc"
+	"github.com/victor-leee/scrpc/metadata"
 	"google.golang.org/protobuf/proto"
+	"io"
+	"net"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 )
 
+// internalMethodPrefix is the prefix of methods handled by scrpc itself rather than registered by users
+const internalMethodPrefix = "__"
+
+// acceptRetryDelay is the wait before accepting again after a failure of the listener
+const acceptRetryDelay = 100 * time.Millisecond
+
 type PluginHandler func(b []byte) (proto.Message, error)
 
-func ackSetUsage(_ []byte) (proto.Message, error) {
+// ContextHandler is a PluginHandler which receives the request context,
+// the context carries the trace of the request so outbound calls made with it join the same trace
+type ContextHandler func(ctx context.Context, b []byte) (proto.Message, error)
+
+// errNoAnswer is returned by the internal handlers of messages the side-car expects no answer to
+var errNoAnswer = errors.New("no answer expected")
+
+func ackSetUsage(_ context.Context, _ []byte) (proto.Message, error) {
 	logrus.Info("ack success")
-	return nil, errors.New("ack success")
+	return nil, errNoAnswer
 }
 
 type Server interface {
 	RegisterHandler(name string, h PluginHandler)
+	RegisterContextHandler(name string, h ContextHandler)
+	// RegisterStreamHandler registers a handler of a server-streaming method
+	RegisterStreamHandler(name string, h StreamHandler)
+	// RegisterClientStreamHandler registers a handler of a client-streaming method
+	RegisterClientStreamHandler(name string, h ClientStreamHandler)
+	// RegisterBidiStreamHandler registers a handler of a bidi-streaming method
+	RegisterBidiStreamHandler(name string, h BidiStreamHandler)
 	Start() error
 	WaitTermination()
+	// PoolStats returns the stats of the connection pools used by the server keyed by cname
+	PoolStats() map[string]PoolStats
+	// Close stops watching the configuration file, stops accepting peers and closes the idle connections,
+	// Start fails with ErrClosed afterwards
+	Close() error
 }
 
 type serverImpl struct {
-	cname       string
-	handlers    map[string]PluginHandler
-	connManager Manager
+	cname          string
+	handlers       map[string]ContextHandler
+	streamHandlers map[string]StreamHandler
+	bidiHandlers   map[string]BidiStreamHandler
+	connManager    Manager
+	interceptors   []ServerInterceptor
+	// streamInterceptors are called for the server, client and bidi streams served
+	streamInterceptors []StreamInterceptor
+	// compressThreshold is the body size from which responses are compressed with the compressor of the caller
+	compressThreshold int
+	// streamWindow is the receive window of the client and bidi streams served, counted in frames
+	streamWindow int
+	// readOpts are set by WithMaxRequestSize, the limits of the configuration are used if they are nil
+	readOpts []ReadOpt
+	// listener accepts the peer side-cars in TransportRemote mode
+	listener *Listener
+	// cfg is the resolved configuration, its error is returned by Start if it's invalid
+	cfg liveConfig
+}
+
+type ServerOpt func(server *serverImpl)
+
+// WithServerConfig sets the configuration of the server, its zero-valued fields are filled by DefaultConfig.
+// The options setting the same values explicitly take precedence. If the resolved configuration is invalid,
+// NewServer returns an error wrapping ErrInvalidConfig and Start fails with it
+func WithServerConfig(cfg *Config) ServerOpt {
+	return func(server *serverImpl) {
+		server.cfg.explicit = cfg
+	}
+}
+
+// WithServerConfigFile reads the configuration of the server from the file at path, see FileConfig, it takes
+// precedence over WithServerConfig. The file is watched, the connection pools are resized and the new connections
+// are dialed with the new settings when it changes. A change which can't be parsed, doesn't pass Validate or
+// changes the transport mode or paths is logged and ignored. Close stops watching the file
+func WithServerConfigFile(path string) ServerOpt {
+	return func(server *serverImpl) {
+		server.cfg.file = path
+	}
+}
+
+// WithServerInterceptors appends interceptors to the server, they are called in the order they are added
+// and are skipped for internal handlers
+func WithServerInterceptors(interceptors ...ServerInterceptor) ServerOpt {
+	return func(server *serverImpl) {
+		server.interceptors = append(server.interceptors, interceptors...)
+	}
 }
 
-func NewServer(serverCname string) Server {
-	return &serverImpl{
-		cname: serverCname,
-		handlers: map[string]PluginHandler{
+// WithServerStreamInterceptors appends interceptors of the streams served, they are called in the order they are
+// added. The items of batches are served by the handlers wrapped by the interceptors of WithServerInterceptors
+func WithServerStreamInterceptors(interceptors ...StreamInterceptor) ServerOpt {
+	return func(server *serverImpl) {
+		server.streamInterceptors = append(server.streamInterceptors, interceptors...)
+	}
+}
+
+// WithResponseCompressThreshold sets the body size in bytes from which responses are compressed,
+// DefaultCompressThreshold by default
+func WithResponseCompressThreshold(n int) ServerOpt {
+	return func(server *serverImpl) {
+		server.compressThreshold = n
+	}
+}
+
+// WithStreamWindow sets the receive window of the client and bidi streams served counted in frames,
+// DefaultStreamWindow by default. It's announced to the client when the stream is opened
+func WithStreamWindow(frames int) ServerOpt {
+	return func(server *serverImpl) {
+		server.streamWindow = frames
+	}
+}
+
+// WithMaxRequestSize limits the size of the header and the body of requests, Config.Limits by default. Unary requests with an oversized body are answered with ErrMessageTooLarge
+func WithMaxRequestSize(maxHeaderSize, maxBodySize uint64) ServerOpt {
+	return func(server *serverImpl) {
+		server.readOpts = []ReadOpt{MaxHeaderSize(maxHeaderSize), MaxBodySize(maxBodySize)}
+	}
+}
+
+// NewServer creates the server of the service serverCname configured by opts. If the configuration is invalid,
+// the error wrapping ErrInvalidConfig is returned along with a server whose Start fails with it
+func NewServer(serverCname string, opts ...ServerOpt) (Server, error) {
+	s := &serverImpl{
+		cname:             serverCname,
+		compressThreshold: DefaultCompressThreshold,
+		streamWindow:      DefaultStreamWindow,
+		handlers: map[string]ContextHandler{
 			"__ack_set_usage": ackSetUsage,
 		},
-		connManager: InitConnManager(func(cname string) (ConnPool, error) {
-			localTransportCfg := GetConfig().LocalTransportConfig
-			return NewPool(WithInitSize(localTransportCfg.PoolCfg.InitSize),
-				WithMaxSize(localTransportCfg.PoolCfg.MaxSize),
-				WithFactory(func() (*Conn, error) {
-					return Dial(localTransportCfg.Protocol, cname)
-				}))
-		}),
+		streamHandlers: make(map[string]StreamHandler),
+		bidiHandlers:   make(map[string]BidiStreamHandler),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.streamWindow <= 0 {
+		s.streamWindow = DefaultStreamWindow
 	}
+	// the built-in configuration keeps the server usable if the configuration is invalid
+	cfgErr := s.cfg.resolve()
+	s.connManager = InitConnManager(func(cname string) (ConnPool, error) {
+		poolCfg := s.cfg.config().LocalTransportConfig.PoolCfg
+		return NewPool(WithInitSize(poolCfg.InitSize),
+			WithMaxSize(poolCfg.MaxSize),
+			WithFactory(func() (*Conn, error) {
+				// the current configuration is read on every dial so that a reload applies to the new connections
+				cfg := s.cfg.config()
+				localTransportCfg := cfg.LocalTransportConfig
+				dialOpts := cfg.dialOpts(localTransportCfg, s.requestLimits(cfg))
+				return DialTimeout(localTransportCfg.Protocol, cname, cfg.Timeouts.GetDial(), dialOpts...)
+			}))
+	})
+	s.cfg.watch(s.reload)
+
+	return s, cfgErr
+}
+
+// reload applies the pool sizes of a reloaded configuration
+func (s *serverImpl) reload(_, cfg *Config) {
+	transportCfg := cfg.LocalTransportConfig
+	if err := s.connManager.Resize(transportCfg.Path, transportCfg.PoolCfg.MaxSize); err != nil {
+		logrus.Warnf("[serverImpl.reload] resize pool %s failed: %v", transportCfg.Path, err)
+	}
+}
+
+// requestLimits are the limits of the requests, the ones of WithMaxRequestSize or else the ones of cfg
+func (s *serverImpl) requestLimits(cfg *Config) []ReadOpt {
+	if s.readOpts != nil {
+		return s.readOpts
+	}
+
+	return []ReadOpt{MaxHeaderSize(cfg.Limits.MaxHeaderSize), MaxBodySize(cfg.Limits.MaxBodySize)}
 }
 
 func (s *serverImpl) RegisterHandler(name string, h PluginHandler) {
+	s.handlers[name] = func(ctx context.Context, b []byte) (proto.Message, error) {
+		// a PluginHandler can't tell the codec of b, so it only understands protobuf requests
+		if c := CodecFromContext(ctx); c.Name() != codec.Proto {
+			return nil, fmt.Errorf("%w: %s by method %s", ErrCodecNotSupported, c.Name(), name)
+		}
+		return h(b)
+	}
+}
+
+func (s *serverImpl) RegisterContextHandler(name string, h ContextHandler) {
 	s.handlers[name] = h
 }
 
+func (s *serverImpl) RegisterStreamHandler(name string, h StreamHandler) {
+	s.streamHandlers[name] = h
+}
+
+func (s *serverImpl) RegisterClientStreamHandler(name string, h ClientStreamHandler) {
+	s.bidiHandlers[name] = clientStreamToBidi(h)
+}
+
+func (s *serverImpl) RegisterBidiStreamHandler(name string, h BidiStreamHandler) {
+	s.bidiHandlers[name] = h
+}
+
 func (s *serverImpl) Start() error {
+	if err := s.cfg.err(); err != nil {
+		return err
+	}
+	if cfg := s.cfg.config(); cfg.Mode == TransportRemote {
+		return s.listen(cfg)
+	}
 	// TODO use heartbeat mechanisms to detect side-car readiness
-	for i := 0; i < GetConfig().LocalTransportConfig.PoolCfg.InitSize; i++ {
+	for i := 0; i < s.cfg.config().LocalTransportConfig.PoolCfg.InitSize; i++ {
 		if err := s.waitMsg(); err != nil {
 			logrus.Errorf("[Start] start message connection failed: %v", err)
 		}
@@ -62,7 +236,7 @@ func (s *serverImpl) Start() error {
 }
 
 func (s *serverImpl) waitMsg() error {
-	outErr := s.connManager.Func(GetConfig().LocalTransportConfig.Path, func(conn *Conn) error {
+	outErr := s.connManager.Func(s.cfg.config().LocalTransportConfig.Path, func(conn *Conn) error {
 		// the connection is used to receive requests
 		_, buildErr := FromBody([]byte{}, &scrpc.Header{
 			MessageType:       scrpc.Header_SET_USAGE,
@@ -72,35 +246,218 @@ func (s *serverImpl) waitMsg() error {
 			return buildErr
 		}
 
-		for {
-			msg, readErr := FromReader(conn, blockRead)
-			if readErr != nil {
+		return s.serve(conn)
+	})
+	if outErr != nil {
+		return outErr
+	}
+
+	return nil
+}
+
+// listen serves the peer side-cars dialing RemoteTransportConfig.Path in TransportRemote mode,
+// the server acts as its own side-car
+func (s *serverImpl) listen(cfg *Config) error {
+	transportCfg := cfg.RemoteTransportConfig
+	if transportCfg.Path == "" {
+		return fmt.Errorf("%w: RemoteTransportConfig.Path is empty", ErrInvalidConfig)
+	}
+	lis, err := Listen(transportCfg.Protocol, transportCfg.Path, WithListenerType(ConnTypeSideCar2SideCar),
+		WithListenerConnOpts(cfg.dialOpts(transportCfg, s.requestLimits(cfg))...))
+	if err != nil {
+		return err
+	}
+	s.listener = lis
+	logrus.Infof("[listen] %s serving peers on %s", s.cname, lis.Addr())
+	go s.accept(lis)
+
+	return nil
+}
+
+func (s *serverImpl) accept(lis *Listener) {
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logrus.Errorf("[accept] accept connection failed: %v", err)
+			time.Sleep(acceptRetryDelay)
+			continue
+		}
+		go s.servePeer(conn)
+	}
+}
+
+// servePeer answers the requests of a peer side-car until it closes conn
+func (s *serverImpl) servePeer(conn *Conn) {
+	if err := conn.AcceptHandshake(); err != nil {
+		logrus.Warnf("[servePeer] handshake with %s failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+	if err := s.serve(conn); err != nil && !errors.Is(err, io.EOF) {
+		logrus.Warnf("[servePeer] serve %s failed: %v", conn.RemoteAddr(), err)
+	}
+	if err := conn.Close(); err != nil {
+		logrus.Debugf("[servePeer] close %s failed: %v", conn.RemoteAddr(), err)
+	}
+}
+
+// serve answers the requests read from conn until it fails
+func (s *serverImpl) serve(conn *Conn) error {
+	for {
+		msg, readErr := ReadMessage(conn)
+		if readErr != nil {
+			if msg == nil || !errors.Is(readErr, ErrMessageTooLarge) {
 				return readErr
 			}
-			h := s.handlers[msg.Header.ReceiverMethodName]
-			resp, err := h(msg.Body)
-			// a little tricky about error handling here
-			if err != nil {
-				// TODO LOG HERE
-				continue
+			// the body was discarded, the connection is still usable
+			s.reject(conn, msg, readErr)
+			continue
+		}
+		if name := msg.Header.Codec; name != "" && codec.Get(name) == nil {
+			// the body can't be decoded, rather than decoding it with another codec the caller is told why
+			s.reject(conn, msg, fmt.Errorf("%w: %s", ErrUnknownCodec, name))
+			continue
+		}
+		if msg.Header.MessageType == scrpc.Header_STREAM_OPEN {
+			// the stream holds the connection until both sides ended it
+			enc := responseEncoding(conn, msg.Header, s.compressThreshold)
+			if streamErr := serveBidiStream(conn, msg, s.bidiHandlers[msg.Header.ReceiverMethodName], enc,
+				s.streamWindow, s.streamInterceptors); streamErr != nil {
+				return streamErr
+			}
+			continue
+		}
+		if msg.Header.MessageType == scrpc.Header_BATCH {
+			if _, writeErr := s.serveBatch(conn, msg).Write(conn); writeErr != nil {
+				logrus.Errorf("[serve] write batch response failed: %v", writeErr)
 			}
-			_, writeErr := FromProtoMessage(resp, nil).Write(conn)
-			if writeErr != nil {
-				// TODO LOG HERE
-				continue
+			continue
+		}
+		if sh := s.streamHandlers[msg.Header.ReceiverMethodName]; sh != nil {
+			if streamErr := serveStream(conn, msg, sh, responseEncoding(conn, msg.Header, s.compressThreshold),
+				s.streamInterceptors); streamErr != nil {
+				logrus.Errorf("[serve] serve stream %s failed: %v", msg.Header.ReceiverMethodName, streamErr)
 			}
+			continue
+		}
+		h := s.handler(msg.Header)
+		if h == nil {
+			s.answerError(conn, msg, fmt.Errorf("no handler registered for method %s", msg.Header.ReceiverMethodName))
+			continue
+		}
+		ctx, respHeader := handlerContext(msg.Header)
+		resp, err := h(ctx, msg.Body)
+		if err != nil {
+			s.answerError(conn, msg, err)
+			continue
+		}
+		if msg.Header.OneWay {
+			// nobody waits for the response of a one-way request
+			continue
+		}
+		rpcResp, buildErr := responseEncoding(conn, msg.Header, s.compressThreshold).message(resp, &scrpc.Header{
+			TraceId: msg.Header.TraceId,
+			SpanId:  msg.Header.SpanId,
+			Extra:   respHeader.extra(),
+		})
+		if buildErr != nil {
+			s.answerError(conn, msg, fmt.Errorf("build response failed: %w", buildErr))
+			continue
+		}
+		if _, writeErr := rpcResp.Write(conn); writeErr != nil {
+			logrus.Errorf("[serve] write response of %s failed: %v", msg.Header.ReceiverMethodName, writeErr)
 		}
+	}
+}
 
-	})
-	if outErr != nil {
-		return outErr
+// answerError answers the unary request msg failing with err, the caller fails with ErrRemote.
+// One-way requests and the messages expecting no answer are only logged
+func (s *serverImpl) answerError(conn *Conn, msg *Message, err error) {
+	if errors.Is(err, errNoAnswer) {
+		return
+	}
+	logrus.Warnf("[serve] request to %s failed: %v", msg.Header.ReceiverMethodName, err)
+	if msg.Header.OneWay {
+		return
+	}
+	if _, writeErr := FromBody([]byte{}, ErrorHeader(msg.Header, err)).Write(conn); writeErr != nil {
+		logrus.Errorf("[serve] write error of %s failed: %v", msg.Header.ReceiverMethodName, writeErr)
 	}
+}
 
-	return nil
+// reject answers the request msg which can't be served with err, in the form its caller expects
+func (s *serverImpl) reject(conn *Conn, msg *Message, err error) {
+	logrus.Warnf("[waitMsg] reject request to %s: %v", msg.Header.ReceiverMethodName, err)
+	var tp scrpc.Header_RPCMessageType
+	switch {
+	case msg.Header.OneWay:
+		return
+	case msg.Header.MessageType == scrpc.Header_BATCH:
+		tp = scrpc.Header_BATCH
+	case msg.Header.MessageType == scrpc.Header_STREAM_OPEN, s.streamHandlers[msg.Header.ReceiverMethodName] != nil:
+		tp = scrpc.Header_STREAM_END
+	case msg.Header.MessageType != scrpc.Header_SIDE_CAR_PROXY:
+		// stream messages outside of a stream and control messages expect no answer
+		return
+	}
+	_, writeErr := FromBody([]byte{}, &scrpc.Header{
+		MessageType: tp,
+		TraceId:     msg.Header.TraceId,
+		SpanId:      msg.Header.SpanId,
+		StreamId:    msg.Header.StreamId,
+		Extra: map[string]string{
+			errorExtraKey: err.Error(),
+		},
+	}).Write(conn)
+	if writeErr != nil {
+		logrus.Errorf("[waitMsg] write rejection of %s failed: %v", msg.Header.ReceiverMethodName, writeErr)
+	}
+}
+
+// handlerContext builds the context passed to the handler serving a request with header,
+// the returned responseHeader holds the metadata set by the handler through SetHeader
+func handlerContext(header *scrpc.Header) (context.Context, *responseHeader) {
+	ctx := contextWithHeaderTrace(context.Background(), header)
+	ctx = metadata.NewIncomingContext(ctx, incomingMetadata(header))
+	ctx = contextWithCodec(ctx, header)
+
+	return contextWithResponseHeader(ctx)
+}
+
+// handler returns the handler serving the method of header wrapped by interceptors, or nil if there is none
+func (s *serverImpl) handler(header *scrpc.Header) ContextHandler {
+	h := s.handlers[header.ReceiverMethodName]
+	if h == nil || strings.HasPrefix(header.ReceiverMethodName, internalMethodPrefix) {
+		return h
+	}
+
+	return chainServerInterceptors(s.interceptors, header, h)
+}
+
+func (s *serverImpl) PoolStats() map[string]PoolStats {
+	return s.connManager.PoolStats()
 }
 
 func (s *serverImpl) WaitTermination() {
-	sigs := make(chan os.Signal)
+	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 	<-sigs
+	if err := s.Close(); err != nil {
+		logrus.Warnf("[WaitTermination] close server failed: %v", err)
+	}
+}
+
+func (s *serverImpl) Close() error {
+	s.cfg.close()
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	if poolsErr := s.connManager.Close(); err == nil {
+		err = poolsErr
+	}
+
+	return err
 }
@@ -0,0 +1,66 @@
+package scrpc
+
+import (
+	"github.com/victor-leee/scrpc/github.com/victor-leee/scrpc"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"strings"
+	"testing"
+)
+
+// serveSocket serves s over a unix socket and returns the caller end
+func serveSocket(t *testing.T, s Server) *Conn {
+	t.Helper()
+	local, remote := socketPair(t)
+	go s.(*serverImpl).serve(NewConn(local))
+
+	return NewConn(remote)
+}
+
+func TestServerRejectsCodec(t *testing.T) {
+	s, err := NewServer("greeter")
+	if err != nil {
+		t.Fatalf("create server failed: %v", err)
+	}
+	s.RegisterHandler("Hello", func([]byte) (proto.Message, error) {
+		return wrapperspb.String("hello"), nil
+	})
+	conn := serveSocket(t, s)
+
+	tests := []struct {
+		codec string
+		err   error
+	}{
+		{codec: "cbor", err: ErrUnknownCodec},
+		// a PluginHandler only decodes protobuf
+		{codec: "json", err: ErrCodecNotSupported},
+	}
+	for _, tt := range tests {
+		if _, err := FromBody([]byte("{}"), &scrpc.Header{
+			MessageType:         scrpc.Header_SIDE_CAR_PROXY,
+			ReceiverServiceName: "greeter",
+			ReceiverMethodName:  "Hello",
+			Codec:               tt.codec,
+		}).Write(conn); err != nil {
+			t.Fatalf("write request failed: %v", err)
+		}
+		resp, err := ReadMessage(conn)
+		if err != nil {
+			t.Fatalf("read response failed: %v", err)
+		}
+		if got := resp.Header.Extra[errorExtraKey]; !strings.Contains(got, tt.err.Error()) {
+			t.Errorf("codec %s got error %q, expected %q", tt.codec, got, tt.err)
+		}
+	}
+}
+
+func TestIncomingMetadataSkipsReservedKeys(t *testing.T) {
+	md := incomingMetadata(&scrpc.Header{Extra: map[string]string{
+		"scrpc-traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+		errorExtraKey:       "failed",
+		"tenant":            "acme",
+	}})
+	if len(md) != 1 || md.Get("tenant") != "acme" {
+		t.Errorf("got metadata %v, expected only tenant", md)
+	}
+}
@@ -0,0 +1,147 @@
+package sidecar
+
+import (
+	"errors"
+	"github.com/sirupsen/logrus"
+	"github.com/victor-leee/scrpc"
+	"sync"
+	"time"
+)
+
+var (
+	// errNoBackend is returned if no server of the receiver service registered a connection
+	errNoBackend = errors.New("no server registered")
+	// errBackendBusy is returned if every connection of the receiver service stayed in use until the queue timeout
+	errBackendBusy = errors.New("all servers busy")
+)
+
+// maxBackendConns is the number of connections a service may register
+const maxBackendConns = 1024
+
+// backend holds the connections registered by the servers of a service with SET_USAGE,
+// every connection serves one request at a time
+type backend struct {
+	idle chan *scrpc.Conn
+	mux  sync.Mutex
+	open int
+}
+
+func newBackend() *backend {
+	return &backend{
+		idle: make(chan *scrpc.Conn, maxBackendConns),
+	}
+}
+
+// register adds conn to the connections of the backend, it's closed if the backend is full
+func (b *backend) register(conn *scrpc.Conn) bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	select {
+	case b.idle <- conn:
+		b.open++
+		return true
+	default:
+		return false
+	}
+}
+
+func (b *backend) size() int {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	return b.open
+}
+
+// acquire takes an idle connection, waiting up to timeout for one to be released
+func (b *backend) acquire(timeout time.Duration) (*scrpc.Conn, error) {
+	select {
+	case conn := <-b.idle:
+		return conn, nil
+	default:
+	}
+	if b.size() == 0 {
+		return nil, errNoBackend
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case conn := <-b.idle:
+		return conn, nil
+	case <-timer.C:
+		return nil, errBackendBusy
+	}
+}
+
+// release puts conn back, a broken connection is closed and forgotten
+func (b *backend) release(conn *scrpc.Conn, broken bool) {
+	if !broken {
+		b.idle <- conn
+		return
+	}
+	b.mux.Lock()
+	b.open--
+	b.mux.Unlock()
+	if err := conn.Close(); err != nil {
+		logrus.Debugf("[backend.release] close connection failed: %v", err)
+	}
+}
+
+// registry holds the backends keyed by service name
+type registry struct {
+	mux      sync.RWMutex
+	backends map[string]*backend
+}
+
+func newRegistry() *registry {
+	return &registry{
+		backends: make(map[string]*backend),
+	}
+}
+
+func (r *registry) get(service string) *backend {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	return r.backends[service]
+}
+
+func (r *registry) getOrCreate(service string) *backend {
+	if b := r.get(service); b != nil {
+		return b
+	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.backends[service] == nil {
+		r.backends[service] = newBackend()
+	}
+
+	return r.backends[service]
+}
+
+// acquire takes an idle connection to service
+func (r *registry) acquire(service string, timeout time.Duration) (*backend, *scrpc.Conn, error) {
+	b := r.get(service)
+	if b == nil {
+		return nil, nil, errNoBackend
+	}
+	conn, err := b.acquire(timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return b, conn, nil
+}
+
+// services returns the number of connections registered by every service
+func (r *registry) services() map[string]int {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	services := make(map[string]int, len(r.backends))
+	for service, b := range r.backends {
+		services[service] = b.size()
+	}
+
+	return services
+}
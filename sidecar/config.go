@@ -0,0 +1,53 @@
+package sidecar
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	config_backend "github.com/victor-leee/scrpc/github.com/victor-leee/config-backend"
+	"google.golang.org/protobuf/proto"
+)
+
+// errNoConfigBackend is returned to CONFIG_CENTER messages if the proxy has no ConfigBackend
+var errNoConfigBackend = errors.New("no config backend")
+
+// ConfigBackend answers the CONFIG_CENTER messages
+type ConfigBackend interface {
+	// Handle serves a request to method, body is serialized by protobuf
+	Handle(ctx context.Context, method string, body []byte) (proto.Message, error)
+}
+
+// ConfigBackendFunc adapts a function to ConfigBackend
+type ConfigBackendFunc func(ctx context.Context, method string, body []byte) (proto.Message, error)
+
+func (f ConfigBackendFunc) Handle(ctx context.Context, method string, body []byte) (proto.Message, error) {
+	return f(ctx, method, body)
+}
+
+// ConfigService serves the methods of the config backend service by svc
+func ConfigService(svc config_backend.ConfigBackendService) ConfigBackend {
+	return ConfigBackendFunc(func(ctx context.Context, method string, body []byte) (proto.Message, error) {
+		switch method {
+		case "GetConfig":
+			req := &config_backend.GetConfigRequest{}
+			if err := proto.Unmarshal(body, req); err != nil {
+				return nil, err
+			}
+			return svc.GetConfig(ctx, req)
+		case "PutConfig":
+			req := &config_backend.PutConfigRequest{}
+			if err := proto.Unmarshal(body, req); err != nil {
+				return nil, err
+			}
+			return svc.PutConfig(ctx, req)
+		case "GetAllKeys":
+			req := &config_backend.GetAllKeysRequest{}
+			if err := proto.Unmarshal(body, req); err != nil {
+				return nil, err
+			}
+			return svc.GetAllKeys(ctx, req)
+		default:
+			return nil, fmt.Errorf("unknown config backend method %s", method)
+		}
+	})
+}
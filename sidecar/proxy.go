@@ -0,0 +1,589 @@
+// Package sidecar implements the side-car proxy of scrpc in process, so applications can be run and tested
+// without a separate side-car
+package sidecar
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/victor-leee/scrpc"
+	"github.com/victor-leee/scrpc/codec"
+	scrpcpb "github.com/victor-leee/scrpc/github.com/victor-leee/scrpc"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	// DefaultQueueTimeout is the default wait for a connection of the receiver service to become idle
+	DefaultQueueTimeout = time.Second
+	// DefaultForwardTimeout is the default wait for each response of a server
+	DefaultForwardTimeout = 30 * time.Second
+)
+
+// ackSetUsageMethod is the method of the servers acknowledging their registration
+const ackSetUsageMethod = "__ack_set_usage"
+
+var (
+	// ErrProxyClosed is returned by Serve once the proxy is closed
+	ErrProxyClosed = errors.New("proxy is closed")
+	// errRateLimited is the reason of the requests beyond the throttle of their receiver service
+	errRateLimited = errors.New("rate limited")
+)
+
+// Proxy is the side-car of the applications connecting to it: servers register their connections with SET_USAGE,
+// SIDE_CAR_PROXY, BATCH and stream messages are routed to the servers of their receiver service, or to the peer
+// side-car given by the RouteTable if none registered, and CONFIG_CENTER messages are answered by a ConfigBackend
+type Proxy struct {
+	registry       *registry
+	routes         atomic.Value // *RouteTable
+	throttler      *throttler
+	peerCfg        *scrpc.Config
+	peers          scrpc.Manager
+	configBackend  ConfigBackend
+	connOpts       []scrpc.ConnOpt
+	queueTimeout   time.Duration
+	forwardTimeout time.Duration
+
+	mux       sync.Mutex
+	listeners []*scrpc.Listener
+	conns     map[*scrpc.Conn]struct{}
+	closed    bool
+}
+
+type ProxyOpt func(p *Proxy)
+
+// WithConfigBackend answers the CONFIG_CENTER messages by backend, they fail if there's none
+func WithConfigBackend(backend ConfigBackend) ProxyOpt {
+	return func(p *Proxy) {
+		p.configBackend = backend
+	}
+}
+
+// WithRouteTable sets the initial route table, see SetRouteTable
+func WithRouteTable(table *RouteTable) ProxyOpt {
+	return func(p *Proxy) {
+		p.routes.Store(table)
+	}
+}
+
+// WithPeerConfig dials the peer side-cars over cfg.RemoteTransportConfig with the timeouts and the limits of cfg,
+// the configuration resolved from the environment is used by default
+func WithPeerConfig(cfg *scrpc.Config) ProxyOpt {
+	return func(p *Proxy) {
+		p.peerCfg = cfg
+	}
+}
+
+// WithConnOpts applies opts to the connections accepted by ListenAndServe and ListenAndServePeers
+func WithConnOpts(opts ...scrpc.ConnOpt) ProxyOpt {
+	return func(p *Proxy) {
+		p.connOpts = append(p.connOpts, opts...)
+	}
+}
+
+// WithQueueTimeout sets how long a request waits for a connection of its receiver service to become idle,
+// DefaultQueueTimeout by default. A request which waited too long is answered with THROTTLED
+func WithQueueTimeout(d time.Duration) ProxyOpt {
+	return func(p *Proxy) {
+		p.queueTimeout = d
+	}
+}
+
+// WithForwardTimeout sets how long each response of a server is waited for, DefaultForwardTimeout by default,
+// zero means no timeout. The connection of a server which timed out is closed
+func WithForwardTimeout(d time.Duration) ProxyOpt {
+	return func(p *Proxy) {
+		p.forwardTimeout = d
+	}
+}
+
+func NewProxy(opts ...ProxyOpt) *Proxy {
+	p := &Proxy{
+		registry:       newRegistry(),
+		throttler:      newThrottler(),
+		queueTimeout:   DefaultQueueTimeout,
+		forwardTimeout: DefaultForwardTimeout,
+		conns:          make(map[*scrpc.Conn]struct{}),
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	if table := p.routeTable(); table != nil {
+		p.throttler.update(table)
+	}
+	if p.peerCfg == nil {
+		var err error
+		if p.peerCfg, err = scrpc.ResolveConfig(nil); err != nil {
+			logrus.Errorf("[NewProxy] %v, the peer side-cars can't be reached", err)
+			return p
+		}
+	}
+	p.peers = scrpc.InitConnManager(func(cname string) (scrpc.ConnPool, error) {
+		transportCfg := p.peerCfg.RemoteTransportConfig
+		connOpts := append(p.peerCfg.ConnOpts(transportCfg), scrpc.WithType(scrpc.ConnTypeSideCar2SideCar))
+		return scrpc.NewPool(scrpc.WithInitSize(transportCfg.PoolCfg.InitSize),
+			scrpc.WithMaxSize(transportCfg.PoolCfg.MaxSize),
+			scrpc.WithFactory(func() (*scrpc.Conn, error) {
+				return scrpc.DialTimeout(transportCfg.Protocol, cname, p.peerCfg.Timeouts.GetDial(), connOpts...)
+			}))
+	})
+
+	return p
+}
+
+// SetRouteTable replaces the route table, the throttling state of the services whose limit is unchanged is kept
+func (p *Proxy) SetRouteTable(table *RouteTable) error {
+	if err := table.Validate(); err != nil {
+		return err
+	}
+	p.routes.Store(table)
+	p.throttler.update(table)
+
+	return nil
+}
+
+// routeTable returns the current route table, nil if none was set
+func (p *Proxy) routeTable() *RouteTable {
+	table, _ := p.routes.Load().(*RouteTable)
+
+	return table
+}
+
+// PeerStats returns the stats of the connection pools to the peer side-cars keyed by address
+func (p *Proxy) PeerStats() map[string]scrpc.PoolStats {
+	if p.peers == nil {
+		return nil
+	}
+
+	return p.peers.PoolStats()
+}
+
+// ListenAndServe listens on address and serves the applications connecting to it until the proxy is closed
+func (p *Proxy) ListenAndServe(network, address string) error {
+	lis, err := scrpc.Listen(network, address, scrpc.WithListenerType(scrpc.ConnTypeSideCar2Local),
+		scrpc.WithListenerConnOpts(p.connOpts...))
+	if err != nil {
+		return err
+	}
+
+	return p.Serve(lis)
+}
+
+// ListenAndServePeers listens on address and serves the peer side-cars connecting to it until the proxy is closed,
+// their requests are routed to the servers registered with this proxy only
+func (p *Proxy) ListenAndServePeers(network, address string) error {
+	lis, err := scrpc.Listen(network, address, scrpc.WithListenerType(scrpc.ConnTypeSideCar2SideCar),
+		scrpc.WithListenerConnOpts(p.connOpts...))
+	if err != nil {
+		return err
+	}
+
+	return p.Serve(lis)
+}
+
+// Serve serves the connections accepted by lis until the proxy is closed, the connections of a listener typed
+// scrpc.ConnTypeSideCar2SideCar are peer side-cars. lis is closed along with the proxy
+func (p *Proxy) Serve(lis *scrpc.Listener) error {
+	p.mux.Lock()
+	if p.closed {
+		p.mux.Unlock()
+		return ErrProxyClosed
+	}
+	p.listeners = append(p.listeners, lis)
+	p.mux.Unlock()
+
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			if p.isClosed() {
+				return ErrProxyClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			logrus.Errorf("[Proxy.Serve] accept connection failed: %v", err)
+			continue
+		}
+		if !p.track(conn) {
+			return ErrProxyClosed
+		}
+		go p.serveApp(conn)
+	}
+}
+
+// Services returns the number of connections registered by the servers of every service
+func (p *Proxy) Services() map[string]int {
+	return p.registry.services()
+}
+
+// Close stops the listeners and closes every connection, the first failure is returned and the others are logged
+func (p *Proxy) Close() error {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	var firstErr error
+	keep := func(err error) {
+		if firstErr == nil {
+			firstErr = err
+			return
+		}
+		logrus.Warnf("[Proxy.Close] %v", err)
+	}
+	for _, lis := range p.listeners {
+		if err := lis.Close(); err != nil {
+			keep(err)
+		}
+	}
+	for conn := range p.conns {
+		if err := conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			keep(err)
+		}
+	}
+	p.conns = nil
+	if p.peers != nil {
+		if err := p.peers.Close(); err != nil {
+			keep(err)
+		}
+	}
+
+	return firstErr
+}
+
+func (p *Proxy) isClosed() bool {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	return p.closed
+}
+
+// track records conn so that Close closes it, it's closed at once if the proxy is closed already
+func (p *Proxy) track(conn *scrpc.Conn) bool {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	if p.closed {
+		closeConn(conn)
+		return false
+	}
+	p.conns[conn] = struct{}{}
+
+	return true
+}
+
+// untrack closes conn and forgets it
+func (p *Proxy) untrack(conn *scrpc.Conn) {
+	p.mux.Lock()
+	delete(p.conns, conn)
+	p.mux.Unlock()
+	closeConn(conn)
+}
+
+func closeConn(conn *scrpc.Conn) {
+	if err := conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		logrus.Debugf("[closeConn] close %s failed: %v", conn.RemoteAddr(), err)
+	}
+}
+
+// serveApp reads the messages of an application or a peer side-car until the connection fails
+// or is registered by a server
+func (p *Proxy) serveApp(conn *scrpc.Conn) {
+	fromPeer := conn.Type == scrpc.ConnTypeSideCar2SideCar
+	if err := conn.AcceptHandshake(); err != nil {
+		logrus.Warnf("[serveApp] handshake failed: %v", err)
+		p.untrack(conn)
+		return
+	}
+	for {
+		msg, err := scrpc.ReadMessage(conn)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !p.isClosed() {
+				logrus.Warnf("[serveApp] read message failed: %v", err)
+			}
+			p.untrack(conn)
+			return
+		}
+		switch msg.Header.MessageType {
+		case scrpcpb.Header_SET_USAGE:
+			// the connection belongs to the server from now on
+			p.register(conn, msg.Header)
+			return
+		case scrpcpb.Header_CONFIG_CENTER:
+			err = p.answerConfig(conn, msg)
+		case scrpcpb.Header_SIDE_CAR_PROXY, scrpcpb.Header_BATCH:
+			if !p.throttler.allow(msg.Header.ReceiverServiceName) {
+				err = throttle(conn, msg, errRateLimited)
+				break
+			}
+			err = p.forward(conn, msg, fromPeer)
+		case scrpcpb.Header_STREAM_OPEN:
+			if !p.throttler.allow(msg.Header.ReceiverServiceName) {
+				err = throttle(conn, msg, errRateLimited)
+				break
+			}
+			err = p.forwardStream(conn, msg, fromPeer)
+		default:
+			logrus.Warnf("[serveApp] drop %s message outside of a stream", msg.Header.MessageType)
+		}
+		if err != nil {
+			logrus.Warnf("[serveApp] serve %s message to %s.%s failed: %v", msg.Header.MessageType,
+				msg.Header.ReceiverServiceName, msg.Header.ReceiverMethodName, err)
+			p.untrack(conn)
+			return
+		}
+	}
+}
+
+// register adds the connection of a server to the backend of its service
+func (p *Proxy) register(conn *scrpc.Conn, header *scrpcpb.Header) {
+	service := header.SenderServiceName
+	if service == "" {
+		logrus.Warn("[register] SET_USAGE without sender service")
+		p.untrack(conn)
+		return
+	}
+	// the server logs the acknowledgement, it doesn't answer it
+	_, err := scrpc.FromBody([]byte{}, &scrpcpb.Header{
+		MessageType:         scrpcpb.Header_SIDE_CAR_PROXY,
+		ReceiverServiceName: service,
+		ReceiverMethodName:  ackSetUsageMethod,
+	}).Write(conn)
+	if err != nil {
+		logrus.Warnf("[register] acknowledge %s failed: %v", service, err)
+		p.untrack(conn)
+		return
+	}
+	if !p.registry.getOrCreate(service).register(conn) {
+		logrus.Warnf("[register] %s registered more than %d connections", service, maxBackendConns)
+		p.untrack(conn)
+		return
+	}
+	logrus.Infof("[register] %s registered a connection", service)
+}
+
+// upstream takes a connection reaching service: one registered by its servers, or else one to the peer side-car
+// of its route unless the request comes from a peer already
+func (p *Proxy) upstream(service string, fromPeer bool) (*scrpc.Conn, func(broken bool), error) {
+	b, conn, err := p.registry.acquire(service, p.queueTimeout)
+	if err == nil {
+		return conn, func(broken bool) {
+			p.release(b, conn, broken)
+		}, nil
+	}
+	route := p.routeTable().route(service)
+	if !errors.Is(err, errNoBackend) || fromPeer || route == nil || route.Peer == "" || p.peers == nil {
+		return nil, nil, fmt.Errorf("%s: %w", service, err)
+	}
+
+	return p.peers.Hold(route.Peer)
+}
+
+// release puts back the connection of a server, a broken one is closed
+func (p *Proxy) release(b *backend, conn *scrpc.Conn, broken bool) {
+	if broken {
+		p.mux.Lock()
+		delete(p.conns, conn)
+		p.mux.Unlock()
+	}
+	b.release(conn, broken)
+}
+
+// throttle answers msg with THROTTLED because it couldn't reach its receiver service
+func throttle(app *scrpc.Conn, msg *scrpc.Message, reason error) error {
+	logrus.Warnf("[throttle] %s.%s: %v", msg.Header.ReceiverServiceName, msg.Header.ReceiverMethodName, reason)
+	if msg.Header.OneWay {
+		return nil
+	}
+	_, err := scrpc.FromBody([]byte{}, &scrpcpb.Header{
+		MessageType: scrpcpb.Header_THROTTLED,
+		TraceId:     msg.Header.TraceId,
+		SpanId:      msg.Header.SpanId,
+		StreamId:    msg.Header.StreamId,
+	}).Write(app)
+
+	return err
+}
+
+// send writes msg to a connection reaching its receiver service. An idle connection may have been closed by its
+// server meanwhile, so a failed write is retried once on another connection if retry is set
+func (p *Proxy) send(msg *scrpc.Message, fromPeer, retry bool) (*scrpc.Conn, func(broken bool), bool, error) {
+	for retried := false; ; retried = true {
+		server, release, err := p.upstream(msg.Header.ReceiverServiceName, fromPeer)
+		if err != nil {
+			return nil, nil, retried, err
+		}
+		if _, err = msg.Forward().Write(server); err == nil {
+			return server, release, retried, nil
+		}
+		release(true)
+		if retried || !retry {
+			return nil, nil, retried, err
+		}
+		logrus.Warnf("[send] write to %s failed, retrying on another connection: %v",
+			msg.Header.ReceiverServiceName, err)
+	}
+}
+
+// closedByServer reports whether err says the server closed its connection
+func closedByServer(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// readResponse reads the next message of server within the forward timeout
+func (p *Proxy) readResponse(server *scrpc.Conn) (*scrpc.Message, error) {
+	if p.forwardTimeout > 0 {
+		if err := server.SetReadDeadline(time.Now().Add(p.forwardTimeout)); err != nil {
+			return nil, err
+		}
+	}
+
+	return scrpc.ReadMessage(server)
+}
+
+// forward sends a unary, batch or server-streaming request to a server of its receiver service
+// and relays the responses until one which isn't a STREAM_FRAME. A connection closed by its server before any
+// response is taken for a stale one, the request is sent once more on another connection then
+func (p *Proxy) forward(app *scrpc.Conn, msg *scrpc.Message, fromPeer bool) error {
+	server, release, retried, err := p.send(msg, fromPeer, true)
+	if err != nil {
+		return throttle(app, msg, err)
+	}
+	if msg.Header.OneWay {
+		release(false)
+		return nil
+	}
+
+	resp, readErr := p.readResponse(server)
+	if readErr != nil && !retried && closedByServer(readErr) {
+		release(true)
+		logrus.Warnf("[forward] %s closed the connection before answering, retrying on another connection: %v",
+			msg.Header.ReceiverServiceName, readErr)
+		if server, release, _, err = p.send(msg, fromPeer, false); err != nil {
+			return throttle(app, msg, err)
+		}
+		resp, readErr = p.readResponse(server)
+	}
+	relayed := false
+	var appErr error
+	for {
+		if readErr != nil {
+			release(true)
+			if relayed {
+				return fmt.Errorf("read response failed: %w", readErr)
+			}
+			_, err = scrpc.FromBody([]byte{}, scrpc.ErrorHeader(msg.Header, readErr)).Write(app)
+			return err
+		}
+		// the server is drained even if the application is gone, so its connection stays in sync
+		if appErr == nil {
+			_, appErr = resp.Forward().Write(app)
+			relayed = true
+		}
+		if resp.Header.MessageType != scrpcpb.Header_STREAM_FRAME {
+			break
+		}
+		resp, readErr = p.readResponse(server)
+	}
+	if err = server.SetReadDeadline(time.Time{}); err != nil {
+		release(true)
+		return appErr
+	}
+	release(false)
+
+	return appErr
+}
+
+// forwardStream opens a client or bidi stream on a server of its receiver service and relays the messages of
+// both sides until each of them sent STREAM_END
+func (p *Proxy) forwardStream(app *scrpc.Conn, msg *scrpc.Message, fromPeer bool) error {
+	server, release, _, err := p.send(msg, fromPeer, true)
+	if err != nil {
+		return throttle(app, msg, err)
+	}
+
+	serverDone := make(chan error, 1)
+	go func() {
+		serverErr := relayStream(server, app)
+		if serverErr != nil {
+			// the application is waiting for the end of the stream which won't come
+			closeConn(app)
+		}
+		serverDone <- serverErr
+	}()
+	if err = relayStream(app, server); err != nil {
+		// closing the server connection stops the relay of its messages
+		release(true)
+		<-serverDone
+		return err
+	}
+	if err = <-serverDone; err != nil {
+		release(true)
+		return err
+	}
+	release(false)
+
+	return nil
+}
+
+// relayStream copies the messages of a stream from src to dst until a STREAM_END
+func relayStream(src, dst *scrpc.Conn) error {
+	for {
+		msg, err := scrpc.ReadMessage(src)
+		if err != nil {
+			return err
+		}
+		if _, err = msg.Forward().Write(dst); err != nil {
+			return err
+		}
+		if msg.Header.MessageType == scrpcpb.Header_STREAM_END {
+			return nil
+		}
+	}
+}
+
+// answerConfig answers a CONFIG_CENTER message by the ConfigBackend
+func (p *Proxy) answerConfig(app *scrpc.Conn, msg *scrpc.Message) error {
+	resp, err := p.handleConfig(msg)
+	if msg.Header.OneWay {
+		return nil
+	}
+	var answer *scrpc.Message
+	if err != nil {
+		answer = scrpc.FromBody([]byte{}, scrpc.ErrorHeader(msg.Header, err))
+	} else {
+		answer = scrpc.FromBody(resp, &scrpcpb.Header{
+			TraceId: msg.Header.TraceId,
+			SpanId:  msg.Header.SpanId,
+		})
+	}
+	_, err = answer.Write(app)
+
+	return err
+}
+
+func (p *Proxy) handleConfig(msg *scrpc.Message) ([]byte, error) {
+	if p.configBackend == nil {
+		return nil, errNoConfigBackend
+	}
+	if name := msg.Header.Codec; name != "" && name != codec.Proto {
+		if codec.Get(name) == nil {
+			return nil, fmt.Errorf("%w: %s", scrpc.ErrUnknownCodec, name)
+		}
+		return nil, fmt.Errorf("%w: %s by the config backend", scrpc.ErrCodecNotSupported, name)
+	}
+	resp, err := p.configBackend.Handle(context.Background(), msg.Header.ReceiverMethodName, msg.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return proto.Marshal(resp)
+}
@@ -0,0 +1,569 @@
+package sidecar
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/victor-leee/scrpc"
+	"github.com/victor-leee/scrpc/configcenter"
+	config_backend "github.com/victor-leee/scrpc/github.com/victor-leee/config-backend"
+	scrpcpb "github.com/victor-leee/scrpc/github.com/victor-leee/scrpc"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testService = "greeter"
+
+// testEnv is a proxy serving a server of testService and a client, both connected over a unix socket
+type testEnv struct {
+	proxy  *Proxy
+	client scrpc.Client
+	// path is the socket of the proxy
+	path string
+	// notified receives the bodies of the one-way requests served
+	notified chan string
+	// stall blocks the Stall stream handler until the test ends
+	stall chan struct{}
+}
+
+func newTestEnv(t *testing.T, opts ...ProxyOpt) *testEnv {
+	t.Helper()
+
+	return newServerTestEnv(t, nil, opts...)
+}
+
+// newServerTestEnv is newTestEnv whose server is created with serverOpts
+func newServerTestEnv(t *testing.T, serverOpts []scrpc.ServerOpt, opts ...ProxyOpt) *testEnv {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "sc.sock")
+	lis, err := scrpc.Listen("unix", path, scrpc.WithListenerType(scrpc.ConnTypeSideCar2Local))
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	proxy := NewProxy(opts...)
+	go func() {
+		if serveErr := proxy.Serve(lis); !errors.Is(serveErr, ErrProxyClosed) {
+			t.Errorf("serve failed: %v", serveErr)
+		}
+	}()
+	t.Cleanup(func() {
+		if closeErr := proxy.Close(); closeErr != nil {
+			t.Errorf("close proxy failed: %v", closeErr)
+		}
+	})
+
+	cfg := &scrpc.Config{
+		LocalTransportConfig: &scrpc.TransportConfig{
+			Protocol: "unix",
+			Path:     path,
+			PoolCfg:  &scrpc.PoolConfig{InitSize: 1, MaxSize: 4},
+		},
+	}
+	client, err := scrpc.NewClient(scrpc.WithConfig(cfg))
+	if err != nil {
+		t.Fatalf("create client failed: %v", err)
+	}
+	env := &testEnv{
+		proxy:    proxy,
+		client:   client,
+		path:     path,
+		notified: make(chan string, 1),
+		stall:    make(chan struct{}),
+	}
+	server, err := scrpc.NewServer(testService, append([]scrpc.ServerOpt{scrpc.WithServerConfig(cfg)}, serverOpts...)...)
+	if err != nil {
+		t.Fatalf("create server failed: %v", err)
+	}
+	server.RegisterHandler("Hello", func(b []byte) (proto.Message, error) {
+		req := &wrapperspb.StringValue{}
+		if unmarshalErr := proto.Unmarshal(b, req); unmarshalErr != nil {
+			return nil, unmarshalErr
+		}
+		return wrapperspb.String("hello " + req.Value), nil
+	})
+	server.RegisterHandler("Fail", func([]byte) (proto.Message, error) {
+		return nil, errors.New("handler failed")
+	})
+	server.RegisterHandler("Notify", func(b []byte) (proto.Message, error) {
+		req := &wrapperspb.StringValue{}
+		if unmarshalErr := proto.Unmarshal(b, req); unmarshalErr != nil {
+			return nil, unmarshalErr
+		}
+		env.notified <- req.Value
+		return nil, nil
+	})
+	server.RegisterStreamHandler("Count", func(b []byte, stream scrpc.ServerStream) error {
+		n := &wrapperspb.Int32Value{}
+		if unmarshalErr := proto.Unmarshal(b, n); unmarshalErr != nil {
+			return unmarshalErr
+		}
+		for i := int32(1); i <= n.Value; i++ {
+			if sendErr := stream.Send(wrapperspb.Int32(i)); sendErr != nil {
+				return sendErr
+			}
+		}
+		return nil
+	})
+	server.RegisterStreamHandler("Stall", func(_ []byte, stream scrpc.ServerStream) error {
+		if sendErr := stream.Send(wrapperspb.Int32(1)); sendErr != nil {
+			return sendErr
+		}
+		<-env.stall
+		return nil
+	})
+	server.RegisterClientStreamHandler("Sum", func(stream scrpc.ServerRecvStream) (proto.Message, error) {
+		var sum int32
+		for {
+			n := &wrapperspb.Int32Value{}
+			if recvErr := stream.Recv(n); errors.Is(recvErr, io.EOF) {
+				return wrapperspb.Int32(sum), nil
+			} else if recvErr != nil {
+				return nil, recvErr
+			}
+			if n.Value < 0 {
+				return nil, errors.New("negative frame")
+			}
+			sum += n.Value
+		}
+	})
+	server.RegisterBidiStreamHandler("Echo", func(stream scrpc.ServerBidiStream) error {
+		for {
+			msg := &wrapperspb.StringValue{}
+			if recvErr := stream.Recv(msg); errors.Is(recvErr, io.EOF) {
+				return nil
+			} else if recvErr != nil {
+				return recvErr
+			}
+			if sendErr := stream.Send(msg); sendErr != nil {
+				return sendErr
+			}
+		}
+	})
+	go func() {
+		if startErr := server.Start(); startErr != nil {
+			t.Errorf("start server failed: %v", startErr)
+		}
+	}()
+	t.Cleanup(func() {
+		if closeErr := env.client.Close(); closeErr != nil {
+			t.Errorf("close client failed: %v", closeErr)
+		}
+		if closeErr := server.Close(); closeErr != nil {
+			t.Errorf("close server failed: %v", closeErr)
+		}
+	})
+	t.Cleanup(func() {
+		close(env.stall)
+	})
+	env.waitRegistered(t, 1)
+
+	return env
+}
+
+// waitRegistered waits for the server of testService to register n connections
+func (e *testEnv) waitRegistered(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for e.proxy.Services()[testService] != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d registered connections, expected %d", e.proxy.Services()[testService], n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// registerConn registers a connection of testService the way its servers do and returns it
+func (e *testEnv) registerConn(t *testing.T) *scrpc.Conn {
+	t.Helper()
+	conn, err := scrpc.Dial("unix", e.path, scrpc.WithHandshake(true))
+	if err != nil {
+		t.Fatalf("dial proxy failed: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	if _, err = scrpc.FromBody([]byte{}, &scrpcpb.Header{
+		MessageType:       scrpcpb.Header_SET_USAGE,
+		SenderServiceName: testService,
+	}).Write(conn); err != nil {
+		t.Fatalf("register connection failed: %v", err)
+	}
+	if _, err = scrpc.ReadMessage(conn); err != nil {
+		t.Fatalf("read acknowledgement failed: %v", err)
+	}
+
+	return conn
+}
+
+func (e *testEnv) request(service, method string, req, resp proto.Message) *scrpc.RequestContext {
+	return &scrpc.RequestContext{
+		Ctx:           context.Background(),
+		Req:           req,
+		ReqService:    service,
+		ReqMethod:     method,
+		SenderService: "caller",
+		Resp:          resp,
+	}
+}
+
+func TestProxyRegistersServer(t *testing.T) {
+	env := newTestEnv(t)
+
+	if services := env.proxy.Services(); len(services) != 1 || services[testService] != 1 {
+		t.Fatalf("got registered services %v, expected one connection of %s", services, testService)
+	}
+}
+
+func TestProxyForwardsUnary(t *testing.T) {
+	env := newTestEnv(t)
+
+	resp := &wrapperspb.StringValue{}
+	if err := env.client.UnaryRPCRequest(env.request(testService, "Hello", wrapperspb.String("proxy"), resp)); err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	if resp.Value != "hello proxy" {
+		t.Errorf("got %q, expected %q", resp.Value, "hello proxy")
+	}
+}
+
+func TestProxyForwardsHandlerError(t *testing.T) {
+	env := newTestEnv(t)
+
+	for i := 0; i < 3; i++ {
+		start := time.Now()
+		err := env.client.UnaryRPCRequest(env.request(testService, "Fail", wrapperspb.String(""), &wrapperspb.StringValue{}))
+		if !errors.Is(err, scrpc.ErrRemote) {
+			t.Fatalf("got %v, expected ErrRemote", err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("failed request took %v, it should be answered at once", elapsed)
+		}
+	}
+	// the failures don't cost the server its connection
+	if n := env.proxy.Services()[testService]; n != 1 {
+		t.Fatalf("got %d registered connections after the failures, expected 1", n)
+	}
+	resp := &wrapperspb.StringValue{}
+	if err := env.client.UnaryRPCRequest(env.request(testService, "Hello", wrapperspb.String("again"), resp)); err != nil {
+		t.Fatalf("request after the failures failed: %v", err)
+	}
+}
+
+func TestProxyForwardsUnknownMethod(t *testing.T) {
+	env := newTestEnv(t)
+
+	err := env.client.UnaryRPCRequest(env.request(testService, "Missing", wrapperspb.String(""), &wrapperspb.StringValue{}))
+	if !errors.Is(err, scrpc.ErrRemote) {
+		t.Fatalf("got %v, expected ErrRemote", err)
+	}
+}
+
+func TestProxyForwardsBatch(t *testing.T) {
+	env := newTestEnv(t)
+
+	calls := []*scrpc.BatchCall{
+		{Method: "Hello", Req: wrapperspb.String("a"), Resp: &wrapperspb.StringValue{}},
+		{Method: "Fail", Req: wrapperspb.String("b"), Resp: &wrapperspb.StringValue{}},
+		{Method: "Hello", Req: wrapperspb.String("c"), Resp: &wrapperspb.StringValue{}},
+	}
+	if err := env.client.BatchRequest(env.request(testService, "", nil, nil), calls); err != nil {
+		t.Fatalf("batch failed: %v", err)
+	}
+	for i, expected := range []string{"hello a", "", "hello c"} {
+		call := calls[i]
+		if expected == "" {
+			if !errors.Is(call.Err, scrpc.ErrRemote) {
+				t.Errorf("call %d got %v, expected ErrRemote", i, call.Err)
+			}
+			continue
+		}
+		if call.Err != nil || call.Resp.(*wrapperspb.StringValue).Value != expected {
+			t.Errorf("call %d got %v, %v, expected %q", i, call.Resp, call.Err, expected)
+		}
+	}
+}
+
+func TestProxyForwardsServerStream(t *testing.T) {
+	env := newTestEnv(t)
+
+	stream, err := env.client.ServerStreamRequest(env.request(testService, "Count", wrapperspb.Int32(3), nil))
+	if err != nil {
+		t.Fatalf("open stream failed: %v", err)
+	}
+	defer stream.Close()
+	for i := int32(1); ; i++ {
+		frame := &wrapperspb.Int32Value{}
+		recvErr := stream.Recv(frame)
+		if errors.Is(recvErr, io.EOF) {
+			if i != 4 {
+				t.Fatalf("stream ended after %d frames, expected 3", i-1)
+			}
+			break
+		}
+		if recvErr != nil {
+			t.Fatalf("receive frame %d failed: %v", i, recvErr)
+		}
+		if frame.Value != i {
+			t.Fatalf("got frame %d, expected %d", frame.Value, i)
+		}
+	}
+}
+
+func TestProxyForwardsUnknownStreamMethod(t *testing.T) {
+	env := newTestEnv(t)
+
+	stream, err := env.client.ServerStreamRequest(env.request(testService, "Missing", wrapperspb.Int32(3), nil))
+	if err != nil {
+		t.Fatalf("open stream failed: %v", err)
+	}
+	defer stream.Close()
+	if err = stream.Recv(&wrapperspb.Int32Value{}); !errors.Is(err, scrpc.ErrRemote) {
+		t.Fatalf("got %v, expected ErrRemote", err)
+	}
+	// the error answer left the connection in sync
+	resp := &wrapperspb.StringValue{}
+	if err = env.client.UnaryRPCRequest(env.request(testService, "Hello", wrapperspb.String("again"), resp)); err != nil {
+		t.Fatalf("request after the failed stream failed: %v", err)
+	}
+}
+
+func TestProxyServerStreamHonoursContext(t *testing.T) {
+	env := newTestEnv(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	req := env.request(testService, "Stall", wrapperspb.Int32(0), nil)
+	req.Ctx = ctx
+	stream, err := env.client.ServerStreamRequest(req)
+	if err != nil {
+		t.Fatalf("open stream failed: %v", err)
+	}
+	defer stream.Close()
+	if err = stream.Recv(&wrapperspb.Int32Value{}); err != nil {
+		t.Fatalf("receive first frame failed: %v", err)
+	}
+	// the handler never sends the next frame, Recv gives up with ctx
+	start := time.Now()
+	if err = stream.Recv(&wrapperspb.Int32Value{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, expected context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Recv returned after %v, expected it to stop at the deadline", elapsed)
+	}
+}
+
+func TestProxyClientStreamHonoursServerWindow(t *testing.T) {
+	// the client sends more frames than the window of the server before the handler reads them
+	env := newServerTestEnv(t, []scrpc.ServerOpt{scrpc.WithStreamWindow(2)})
+
+	stream, err := env.client.ClientStreamRequest(env.request(testService, "Sum", nil, nil))
+	if err != nil {
+		t.Fatalf("open stream failed: %v", err)
+	}
+	defer stream.Close()
+	var expected int32
+	for i := int32(1); i <= 20; i++ {
+		if err = stream.Send(wrapperspb.Int32(i)); err != nil {
+			t.Fatalf("send frame %d failed: %v", i, err)
+		}
+		expected += i
+	}
+	sum := &wrapperspb.Int32Value{}
+	if err = stream.CloseAndRecv(sum); err != nil {
+		t.Fatalf("close and receive failed: %v", err)
+	}
+	if sum.Value != expected {
+		t.Errorf("got sum %d, expected %d", sum.Value, expected)
+	}
+}
+
+func TestProxyBidiStreamHonoursClientWindow(t *testing.T) {
+	env := newTestEnv(t)
+
+	stream, err := env.client.BidiStreamRequest(env.request(testService, "Echo", nil, nil), scrpc.StreamWindow(2))
+	if err != nil {
+		t.Fatalf("open stream failed: %v", err)
+	}
+	defer stream.Close()
+	// the server blocks once it echoed 2 messages, it reads the rest meanwhile
+	const n = 10
+	for i := 0; i < n; i++ {
+		if err = stream.Send(wrapperspb.String(fmt.Sprint(i))); err != nil {
+			t.Fatalf("send message %d failed: %v", i, err)
+		}
+	}
+	if err = stream.CloseSend(); err != nil {
+		t.Fatalf("close send failed: %v", err)
+	}
+	for i := 0; i < n; i++ {
+		msg := &wrapperspb.StringValue{}
+		if err = stream.Recv(msg); err != nil {
+			t.Fatalf("receive message %d failed: %v", i, err)
+		}
+		if msg.Value != fmt.Sprint(i) {
+			t.Fatalf("got %q, expected %q", msg.Value, fmt.Sprint(i))
+		}
+	}
+	if err = stream.Recv(&wrapperspb.StringValue{}); !errors.Is(err, io.EOF) {
+		t.Fatalf("got %v after the last message, expected io.EOF", err)
+	}
+}
+
+func TestProxyForwardsClientStreamHandlerError(t *testing.T) {
+	env := newTestEnv(t)
+
+	stream, err := env.client.ClientStreamRequest(env.request(testService, "Sum", nil, nil))
+	if err != nil {
+		t.Fatalf("open stream failed: %v", err)
+	}
+	defer stream.Close()
+	// the handler fails at the second frame and leaves the last ones unread
+	for _, n := range []int32{1, -1, 2, 3} {
+		if err = stream.Send(wrapperspb.Int32(n)); err != nil {
+			t.Fatalf("send frame %d failed: %v", n, err)
+		}
+	}
+	if err = stream.CloseAndRecv(&wrapperspb.Int32Value{}); !errors.Is(err, scrpc.ErrRemote) {
+		t.Fatalf("got %v, expected ErrRemote", err)
+	}
+	resp := &wrapperspb.StringValue{}
+	if err = env.client.UnaryRPCRequest(env.request(testService, "Hello", wrapperspb.String("again"), resp)); err != nil {
+		t.Fatalf("request after the failed stream failed: %v", err)
+	}
+}
+
+func TestProxyForwardsUnknownBidiMethod(t *testing.T) {
+	env := newTestEnv(t)
+
+	stream, err := env.client.BidiStreamRequest(env.request(testService, "Missing", nil, nil))
+	if err != nil {
+		t.Fatalf("open stream failed: %v", err)
+	}
+	defer stream.Close()
+	if err = stream.CloseSend(); err != nil {
+		t.Fatalf("close send failed: %v", err)
+	}
+	if err = stream.Recv(&wrapperspb.StringValue{}); !errors.Is(err, scrpc.ErrRemote) {
+		t.Fatalf("got %v, expected ErrRemote", err)
+	}
+	resp := &wrapperspb.StringValue{}
+	if err = env.client.UnaryRPCRequest(env.request(testService, "Hello", wrapperspb.String("again"), resp)); err != nil {
+		t.Fatalf("request after the failed stream failed: %v", err)
+	}
+}
+
+func TestProxyRetriesClosedServerConn(t *testing.T) {
+	env := newTestEnv(t)
+	// the server closed the connection while it was idle, writing to it fails
+	if err := env.registerConn(t).Close(); err != nil {
+		t.Fatalf("close connection failed: %v", err)
+	}
+	env.waitRegistered(t, 2)
+
+	// one of the requests takes the closed connection, whatever their order
+	for i := 0; i < 3; i++ {
+		resp := &wrapperspb.StringValue{}
+		if err := env.client.UnaryRPCRequest(env.request(testService, "Hello", wrapperspb.String("retry"), resp)); err != nil {
+			t.Fatalf("request %d failed: %v", i, err)
+		}
+		if resp.Value != "hello retry" {
+			t.Fatalf("got %q, expected %q", resp.Value, "hello retry")
+		}
+	}
+	env.waitRegistered(t, 1)
+}
+
+func TestProxyRetriesServerClosingBeforeAnswer(t *testing.T) {
+	env := newTestEnv(t)
+	// the server reads the request but closes the connection without answering
+	conn := env.registerConn(t)
+	received := make(chan string, 1)
+	go func() {
+		if msg, err := scrpc.ReadMessage(conn); err == nil {
+			received <- msg.Header.ReceiverMethodName
+		}
+		_ = conn.Close()
+	}()
+	env.waitRegistered(t, 2)
+
+	for i := 0; i < 3; i++ {
+		resp := &wrapperspb.StringValue{}
+		if err := env.client.UnaryRPCRequest(env.request(testService, "Hello", wrapperspb.String("retry"), resp)); err != nil {
+			t.Fatalf("request %d failed: %v", i, err)
+		}
+	}
+	select {
+	case method := <-received:
+		if method != "Hello" {
+			t.Errorf("the closing server got %s, expected Hello", method)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no request reached the closing server")
+	}
+	env.waitRegistered(t, 1)
+}
+
+func TestProxyForwardsOneWay(t *testing.T) {
+	env := newTestEnv(t)
+
+	if err := env.client.OneWayRequest(env.request(testService, "Notify", wrapperspb.String("ping"), nil)); err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	select {
+	case body := <-env.notified:
+		if body != "ping" {
+			t.Errorf("got %q, expected ping", body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("one-way request not served")
+	}
+	// the one-way request left no answer behind on the connection of the server
+	resp := &wrapperspb.StringValue{}
+	if err := env.client.UnaryRPCRequest(env.request(testService, "Hello", wrapperspb.String("after"), resp)); err != nil || resp.Value != "hello after" {
+		t.Fatalf("got %q, %v after the one-way request", resp.Value, err)
+	}
+}
+
+func TestProxyAnswersConfigCenter(t *testing.T) {
+	center := configcenter.New(configcenter.WithServiceKeys(map[string]string{"caller": "secret"}))
+	env := newTestEnv(t, WithConfigBackend(ConfigService(center)))
+
+	configRequest := func(method string, req, resp proto.Message) error {
+		reqCtx := env.request("config-backend", method, req, resp)
+		reqCtx.MessageType = scrpcpb.Header_CONFIG_CENTER.Enum()
+		return env.client.UnaryRPCRequest(reqCtx)
+	}
+	putResp := &config_backend.PutConfigResponse{}
+	err := configRequest("PutConfig", &config_backend.PutConfigRequest{
+		ServiceId: "caller", ServiceKey: "secret", Key: "greeting", Value: "hi",
+	}, putResp)
+	if err != nil || putResp.GetBaseResponse().GetErrCode() != config_backend.ErrorCode_SUCCESS {
+		t.Fatalf("put config got %v, %v", putResp, err)
+	}
+	getResp := &config_backend.GetConfigResponse{}
+	err = configRequest("GetConfig", &config_backend.GetConfigRequest{
+		ServiceId: "caller", ServiceKey: "secret", Key: "greeting",
+	}, getResp)
+	if err != nil || !getResp.KeyExist || getResp.Value != "hi" {
+		t.Fatalf("get config got %v, %v", getResp, err)
+	}
+	err = configRequest("GetConfig", &config_backend.GetConfigRequest{
+		ServiceId: "caller", ServiceKey: "wrong", Key: "greeting",
+	}, getResp)
+	if err != nil || getResp.GetBaseResponse().GetErrCode() != config_backend.ErrorCode_ERR_INVALID_SERVICE_KEY {
+		t.Fatalf("get config with a wrong key got %v, %v", getResp, err)
+	}
+}
+
+func TestProxyThrottlesUnknownService(t *testing.T) {
+	env := newTestEnv(t)
+
+	err := env.client.UnaryRPCRequest(env.request("nobody", "Hello", wrapperspb.String(""), &wrapperspb.StringValue{}))
+	if !errors.Is(err, scrpc.ErrThrottled) {
+		t.Fatalf("got %v, expected ErrThrottled", err)
+	}
+}
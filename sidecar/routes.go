@@ -0,0 +1,92 @@
+package sidecar
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"os"
+	"sort"
+	"strings"
+)
+
+// ErrInvalidRouteTable is returned if a RouteTable doesn't pass Validate
+var ErrInvalidRouteTable = errors.New("invalid route table")
+
+// RouteTable tells the proxy where the services live and how much traffic they accept, it's written in YAML:
+//
+//	services:
+//	  payment:
+//	    peer: 10.0.0.7:7000
+//	    throttle:
+//	      rate: 200
+//	      burst: 50
+type RouteTable struct {
+	Services map[string]*Route `yaml:"services"`
+}
+
+// Route is the route of a service
+type Route struct {
+	// Peer is the address of the side-car of the service, the requests are sent to it if no server of the
+	// service registered with this proxy
+	Peer string `yaml:"peer"`
+	// Throttle limits the requests to the service, they are answered with THROTTLED beyond the limit
+	Throttle *ThrottleConfig `yaml:"throttle"`
+}
+
+// ThrottleConfig is a token bucket refilled by Rate tokens per second up to Burst tokens, every request takes one
+type ThrottleConfig struct {
+	Rate float64 `yaml:"rate"`
+	// Burst is Rate rounded up if it's zero
+	Burst int `yaml:"burst"`
+}
+
+// LoadRouteTable reads the route table at path
+func LoadRouteTable(path string) (*RouteTable, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	table := &RouteTable{}
+	if err = yaml.UnmarshalStrict(b, table); err != nil {
+		return nil, fmt.Errorf("%w: parse %s failed: %v", ErrInvalidRouteTable, path, err)
+	}
+
+	return table, table.Validate()
+}
+
+// route returns the route of service, nil if it has none
+func (t *RouteTable) route(service string) *Route {
+	if t == nil {
+		return nil
+	}
+
+	return t.Services[service]
+}
+
+// Validate checks every route, the returned error wraps ErrInvalidRouteTable and describes all the invalid values
+func (t *RouteTable) Validate() error {
+	services := make([]string, 0, len(t.Services))
+	for service := range t.Services {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+
+	var msgs []string
+	for _, service := range services {
+		route := t.Services[service]
+		if route == nil || route.Throttle == nil {
+			continue
+		}
+		if route.Throttle.Rate <= 0 {
+			msgs = append(msgs, fmt.Sprintf("services[%s].throttle.rate must be positive, got %v", service, route.Throttle.Rate))
+		}
+		if route.Throttle.Burst < 0 {
+			msgs = append(msgs, fmt.Sprintf("services[%s].throttle.burst must not be negative, got %d", service, route.Throttle.Burst))
+		}
+	}
+	if len(msgs) > 0 {
+		return fmt.Errorf("%w: %s", ErrInvalidRouteTable, strings.Join(msgs, "; "))
+	}
+
+	return nil
+}
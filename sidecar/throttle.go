@@ -0,0 +1,91 @@
+package sidecar
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// tokenBucket is the limiter of a ThrottleConfig
+type tokenBucket struct {
+	cfg ThrottleConfig
+
+	mux    sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// normalized returns c with its default burst
+func (c ThrottleConfig) normalized() ThrottleConfig {
+	if c.Burst == 0 {
+		c.Burst = int(math.Ceil(c.Rate))
+	}
+
+	return c
+}
+
+func newTokenBucket(cfg ThrottleConfig) *tokenBucket {
+	cfg = cfg.normalized()
+
+	return &tokenBucket{
+		cfg:    cfg,
+		tokens: float64(cfg.Burst),
+		last:   time.Now(),
+	}
+}
+
+// allow takes a token if there's one left
+func (b *tokenBucket) allow() bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	now := time.Now()
+	b.tokens = math.Min(float64(b.cfg.Burst), b.tokens+now.Sub(b.last).Seconds()*b.cfg.Rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+
+	return true
+}
+
+// throttler holds the token buckets of the services keyed by name
+type throttler struct {
+	mux     sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func newThrottler() *throttler {
+	return &throttler{
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// update follows the throttle configurations of table, the buckets whose configuration is unchanged are kept
+func (t *throttler) update(table *RouteTable) {
+	buckets := make(map[string]*tokenBucket)
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	for service, route := range table.Services {
+		if route == nil || route.Throttle == nil {
+			continue
+		}
+		if b := t.buckets[service]; b != nil && b.cfg == route.Throttle.normalized() {
+			buckets[service] = b
+			continue
+		}
+		buckets[service] = newTokenBucket(*route.Throttle)
+	}
+	t.buckets = buckets
+}
+
+// allow reports whether a request to service is within its limit
+func (t *throttler) allow(service string) bool {
+	t.mux.Lock()
+	b := t.buckets[service]
+	t.mux.Unlock()
+
+	return b == nil || b.allow()
+}
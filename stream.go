@@ -0,0 +1,238 @@
+package scrpc
+
+import (
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/victor-leee/scrpc/github.com/victor-leee/scrpc"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"time"
+)
+
+// ServerStream is used by a StreamHandler to send messages to the client
+type ServerStream interface {
+	// Context returns the context of the request being served
+	Context() context.Context
+	// Send sends m as a STREAM_FRAME to the client
+	Send(m proto.Message) error
+}
+
+// StreamHandler serves a server-streaming request whose body is b, the stream ends when the handler returns
+type StreamHandler func(b []byte, stream ServerStream) error
+
+type serverStream struct {
+	ctx       context.Context
+	conn      *Conn
+	reqHeader *scrpc.Header
+	enc       encoding
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *serverStream) Send(m proto.Message) error {
+	frame, err := s.enc.message(m, &scrpc.Header{
+		MessageType: scrpc.Header_STREAM_FRAME,
+		TraceId:     s.reqHeader.TraceId,
+		SpanId:      s.reqHeader.SpanId,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = frame.Write(s.conn)
+
+	return err
+}
+
+// serveStream calls h with the request msg and closes the stream with a STREAM_END message once h returns,
+// interceptors are told about the stream
+func serveStream(conn *Conn, msg *Message, h StreamHandler, enc encoding, interceptors []StreamInterceptor) error {
+	ctx, respHeader := handlerContext(msg.Header)
+	done := startStream(ctx, interceptors, msg.Header)
+	handlerErr := h(msg.Body, &serverStream{
+		ctx:       ctx,
+		conn:      conn,
+		reqHeader: msg.Header,
+		enc:       enc,
+	})
+	done(handlerErr)
+	extra := respHeader.extra()
+	if handlerErr != nil {
+		extra[errorExtraKey] = handlerErr.Error()
+	}
+	_, err := FromBody([]byte{}, &scrpc.Header{
+		MessageType: scrpc.Header_STREAM_END,
+		TraceId:     msg.Header.TraceId,
+		SpanId:      msg.Header.SpanId,
+		Extra:       extra,
+	}).Write(conn)
+
+	return err
+}
+
+// ServerStreamClient receives the messages of a server stream
+type ServerStreamClient interface {
+	// Recv receives the next message of the stream into m, io.EOF is returned once the stream ended successfully
+	Recv(m proto.Message) error
+	// Close releases the stream, it must be called if the stream is abandoned before Recv returns an error
+	Close() error
+}
+
+type serverStreamClient struct {
+	ctx     context.Context
+	conn    *Conn
+	release func(broken bool)
+	opts    *callOptions
+	// timeout bounds the wait for each message of the stream, on top of the deadline of ctx
+	timeout time.Duration
+	// stopInterrupt stops interrupting conn once ctx is done
+	stopInterrupt func()
+	// done reports the result of the stream to the stream interceptors
+	done func(err error)
+	err  error
+}
+
+// setDeadline bounds the next read or write of the stream
+func (s *serverStreamClient) setDeadline() error {
+	deadline, _ := requestDeadline(s.ctx, s.timeout)
+	if err := s.conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+
+	// ctx may be done before the deadline was set, its interruption would be overridden
+	return s.ctx.Err()
+}
+
+func (s *serverStreamClient) Recv(m proto.Message) error {
+	if s.err != nil {
+		return s.err
+	}
+	if err := s.setDeadline(); err != nil {
+		return s.finish(err, false)
+	}
+	msg, err := ReadMessage(s.conn)
+	if err != nil {
+		return s.finish(err, false)
+	}
+
+	switch msg.Header.MessageType {
+	case scrpc.Header_STREAM_FRAME:
+		if err = unmarshalBody(msg.Header, msg.Body, m); err != nil {
+			// the stream itself is still in sync, so let the caller decide whether to continue
+			return err
+		}
+		return nil
+	case scrpc.Header_STREAM_END:
+		if s.opts.header != nil {
+			*s.opts.header = incomingMetadata(msg.Header)
+		}
+		if errMsg, ok := msg.Header.Extra[errorExtraKey]; ok {
+			return s.finish(fmt.Errorf("%w: %s", ErrRemote, errMsg), true)
+		}
+		return s.finish(io.EOF, true)
+	case scrpc.Header_THROTTLED:
+		return s.finish(ErrThrottled, true)
+	default:
+		if errMsg, ok := msg.Header.Extra[errorExtraKey]; ok {
+			// the request was answered as a unary one, e.g. the method isn't a stream method of the server
+			return s.finish(fmt.Errorf("%w: %s", ErrRemote, errMsg), true)
+		}
+		return s.finish(fmt.Errorf("unexpected message type %s in stream", msg.Header.MessageType), false)
+	}
+}
+
+func (s *serverStreamClient) Close() error {
+	if s.err != nil {
+		return nil
+	}
+	// unread frames are still on the way, the connection can't be reused
+	s.finish(ErrStreamClosed, false)
+
+	return nil
+}
+
+// finish ends the stream with err, the connection is reused only if the stream is in sync
+func (s *serverStreamClient) finish(err error, inSync bool) error {
+	s.stopInterrupt()
+	err = contextError(s.ctx, err)
+	if inSync {
+		if resetErr := s.conn.SetDeadline(time.Time{}); resetErr != nil {
+			logrus.Warnf("[serverStreamClient.finish] reset deadline failed: %v", resetErr)
+			inSync = false
+		}
+	}
+	s.err = err
+	s.release(!inSync)
+	if err == io.EOF {
+		s.done(nil)
+	} else {
+		s.done(err)
+	}
+
+	return err
+}
+
+// ServerStreamRequest sends the request of a server-streaming method and returns the stream of responses,
+// reqCtx.Resp is ignored and client interceptors are not applied, the stream interceptors are
+func (c *clientImpl) ServerStreamRequest(ctx *RequestContext, opts ...CallOpt) (ServerStreamClient, error) {
+	header, err := c.newHeader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	done := startStream(ctx.Ctx, c.streamInterceptors, header)
+	stream, err := c.serverStream(ctx, header, done, opts)
+	if err != nil {
+		done(err)
+		return nil, err
+	}
+
+	return stream, nil
+}
+
+// serverStream sends the request of a server stream with header, the stream reports its result to done
+func (c *clientImpl) serverStream(ctx *RequestContext, header *scrpc.Header, done func(err error),
+	opts []CallOpt) (*serverStreamClient, error) {
+	callOpts := c.newCallOptions(opts)
+	enc, err := callOpts.encoding()
+	if err != nil {
+		return nil, err
+	}
+
+	cname, err := c.route(header.ReceiverServiceName)
+	if err != nil {
+		return nil, err
+	}
+	conn, release, err := c.connManager.Hold(cname)
+	if err != nil {
+		return nil, err
+	}
+	// the request looks unary, the frames of the answer need the peer to support streams
+	if !conn.Supports(FeatureStreams) {
+		release(false)
+		return nil, fmt.Errorf("%w: server stream to %s", ErrUnsupportedFeature, header.ReceiverServiceName)
+	}
+	rpcReq, err := enc.forConn(conn).message(ctx.Req, header)
+	if err != nil {
+		release(false)
+		return nil, err
+	}
+	stream := &serverStreamClient{
+		ctx:           ctx.Ctx,
+		conn:          conn,
+		release:       release,
+		opts:          callOpts,
+		timeout:       c.cfg.config().requestTimeout(header.ReceiverServiceName),
+		stopInterrupt: interruptOnDone(ctx.Ctx, conn),
+		done:          done,
+	}
+	if err = stream.setDeadline(); err != nil {
+		return nil, stream.finish(err, false)
+	}
+	if _, err = rpcReq.Write(conn); err != nil {
+		return nil, stream.finish(err, false)
+	}
+
+	return stream, nil
+}
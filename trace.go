@@ -0,0 +1,88 @@
+package scrpc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/victor-leee/scrpc/github.com/victor-leee/scrpc"
+)
+
+type traceCtxKey struct{}
+
+// traceInfo is the trace state carried by a context
+type traceInfo struct {
+	traceID string
+	spanID  string
+}
+
+// ContextWithTrace returns a copy of ctx carrying traceID and spanID,
+// outbound requests made with the returned context join the trace as children of spanID
+func ContextWithTrace(ctx context.Context, traceID, spanID string) context.Context {
+	return context.WithValue(ctx, traceCtxKey{}, &traceInfo{
+		traceID: traceID,
+		spanID:  spanID,
+	})
+}
+
+// TraceIDFromContext returns the trace id carried by ctx, or an empty string if there is none
+func TraceIDFromContext(ctx context.Context) string {
+	if info := traceFromContext(ctx); info != nil {
+		return info.traceID
+	}
+
+	return ""
+}
+
+// SpanIDFromContext returns the span id carried by ctx, or an empty string if there is none
+func SpanIDFromContext(ctx context.Context) string {
+	if info := traceFromContext(ctx); info != nil {
+		return info.spanID
+	}
+
+	return ""
+}
+
+func traceFromContext(ctx context.Context) *traceInfo {
+	if ctx == nil {
+		return nil
+	}
+	info, _ := ctx.Value(traceCtxKey{}).(*traceInfo)
+
+	return info
+}
+
+// fillTrace sets the trace fields of an outbound header, the trace id is inherited from ctx or generated if
+// ctx has none, and the span id of ctx (the request being served) becomes the parent span id
+func fillTrace(ctx context.Context, header *scrpc.Header) {
+	header.TraceId = TraceIDFromContext(ctx)
+	if header.TraceId == "" {
+		header.TraceId = newTraceID()
+	}
+	header.ParentSpanId = SpanIDFromContext(ctx)
+	header.SpanId = newSpanID()
+}
+
+// contextWithHeaderTrace returns a copy of ctx carrying the trace of an inbound request
+func contextWithHeaderTrace(ctx context.Context, header *scrpc.Header) context.Context {
+	if header.TraceId == "" {
+		return ContextWithTrace(ctx, newTraceID(), newSpanID())
+	}
+
+	return ContextWithTrace(ctx, header.TraceId, header.SpanId)
+}
+
+func newTraceID() string {
+	return randomHex(16)
+}
+
+func newSpanID() string {
+	return randomHex(8)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	// crypto/rand only fails when the OS entropy source is unavailable, an all-zero id is acceptable then
+	_, _ = rand.Read(b)
+
+	return hex.EncodeToString(b)
+}